@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"errors"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -33,10 +35,15 @@ func main() {
 	defer stop()
 
 	srv, err := server.NewServer(config.AppConfig, ins)
+	if err != nil {
+		logger.Errorf("Error creating server: %v", err)
+		os.Exit(1)
+	}
 
 	go func() {
-		if err := srv.Start(); err != nil {
-			logger.Error("Error starting server: %v", err)
+		// Shutdown makes Start return ErrServerClosed while it drains.
+		if err := srv.Start(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Errorf("Error starting server: %v", err)
 			stop()
 		}
 	}()
@@ -44,11 +51,12 @@ func main() {
 	<-ctx.Done()
 	logger.Info("Shutting down server gracefully...")
 
-	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	// Leave time to close the connections that outlast the drain.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.AppConfig.Drain.Timeout+10*time.Second)
 	defer cancel()
 
 	if err := srv.Shutdown(shutdownCtx); err != nil {
-		logger.Error("Error shutting down server: %v", err)
+		logger.Errorf("Error shutting down server: %v", err)
 	}
 	logger.Info("Server exited")
 }
@@ -0,0 +1,217 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jibitesh/request-response-manager/internal/config"
+)
+
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+)
+
+// BearerProtocol is offered by browser clients, followed by the token itself,
+// in Sec-WebSocket-Protocol since they cannot set an Authorization header.
+const BearerProtocol = "bearer"
+
+var (
+	ErrMissingToken = errors.New("auth: missing token")
+	ErrInvalidToken = errors.New("auth: invalid token")
+	ErrTokenExpired = errors.New("auth: token expired")
+)
+
+type Claims map[string]interface{}
+
+func (c Claims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+func (c Claims) time(name string) (time.Time, bool) {
+	n, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(n), 0), true
+}
+
+// ExpiresAt returns the exp claim, if the token has one.
+func (c Claims) ExpiresAt() (time.Time, bool) {
+	return c.time("exp")
+}
+
+func (c Claims) hasAudience(aud string) bool {
+	switch v := c["aud"].(type) {
+	case string:
+		return v == aud
+	case []interface{}:
+		for _, a := range v {
+			if s, ok := a.(string); ok && s == aud {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Verifier validates signed JWTs against keys loaded from config.
+type Verifier struct {
+	algorithms map[string]bool
+	secret     []byte
+	keys       *keySet
+	issuer     string
+	audience   string
+	leeway     time.Duration
+}
+
+func NewVerifier(cfg *config.Config) (*Verifier, error) {
+	jwtCfg := cfg.Auth.JWT
+	v := &Verifier{
+		algorithms: make(map[string]bool),
+		issuer:     jwtCfg.Issuer,
+		audience:   jwtCfg.Audience,
+		leeway:     jwtCfg.Leeway,
+	}
+	for _, alg := range jwtCfg.Algorithms {
+		v.algorithms[alg] = true
+	}
+
+	v.secret = []byte(jwtCfg.Secret)
+	if jwtCfg.SecretFile != "" {
+		b, err := os.ReadFile(jwtCfg.SecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("auth: read secret file: %w", err)
+		}
+		v.secret = []byte(strings.TrimSpace(string(b)))
+	}
+	if v.algorithms[AlgHS256] && len(v.secret) == 0 {
+		return nil, errors.New("auth: HS256 enabled without a secret")
+	}
+
+	keys, err := loadKeys(jwtCfg.PublicKeyFiles, jwtCfg.JWKSFile)
+	if err != nil {
+		return nil, err
+	}
+	v.keys = keys
+	return v, nil
+}
+
+// Verify checks the token's signature and its exp, nbf, iss and aud claims.
+func (v *Verifier) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if !v.algorithms[header.Alg] {
+		return nil, fmt.Errorf("%w: algorithm %q not allowed", ErrInvalidToken, header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	if !v.verifySignature(header.Alg, header.Kid, parts[0]+"."+parts[1], sig) {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	now := time.Now()
+	if exp, ok := claims.ExpiresAt(); ok && now.After(exp.Add(v.leeway)) {
+		return nil, ErrTokenExpired
+	}
+	if nbf, ok := claims.time("nbf"); ok && now.Add(v.leeway).Before(nbf) {
+		return nil, fmt.Errorf("%w: not valid yet", ErrInvalidToken)
+	}
+	if v.issuer != "" && claims.String("iss") != v.issuer {
+		return nil, fmt.Errorf("%w: wrong issuer", ErrInvalidToken)
+	}
+	if v.audience != "" && !claims.hasAudience(v.audience) {
+		return nil, fmt.Errorf("%w: wrong audience", ErrInvalidToken)
+	}
+	return claims, nil
+}
+
+func (v *Verifier) verifySignature(alg, kid, signingInput string, sig []byte) bool {
+	if alg == AlgHS256 {
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write([]byte(signingInput))
+		return hmac.Equal(mac.Sum(nil), sig)
+	}
+
+	digest := sha256.Sum256([]byte(signingInput))
+	for _, key := range v.keys.candidates(kid) {
+		switch pub := key.(type) {
+		case *rsa.PublicKey:
+			if alg == AlgRS256 && rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) == nil {
+				return true
+			}
+		case *ecdsa.PublicKey:
+			if alg == AlgES256 && len(sig) == 64 {
+				r := new(big.Int).SetBytes(sig[:32])
+				s := new(big.Int).SetBytes(sig[32:])
+				if ecdsa.Verify(pub, digest[:], r, s) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// TokenFromRequest finds the bearer token in the Authorization header, the
+// query parameter or the Sec-WebSocket-Protocol list. fromProtocol reports the
+// last case, in which the server must answer with BearerProtocol.
+func TokenFromRequest(r *http.Request, queryParam string) (token string, fromProtocol bool) {
+	if h := r.Header.Get("Authorization"); len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+		return strings.TrimSpace(h[7:]), false
+	}
+	if queryParam != "" {
+		if t := r.URL.Query().Get(queryParam); t != "" {
+			return t, false
+		}
+	}
+	var protocols []string
+	for _, h := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(h, ",") {
+			protocols = append(protocols, strings.TrimSpace(p))
+		}
+	}
+	for i := 0; i < len(protocols)-1; i++ {
+		if protocols[i] == BearerProtocol {
+			return protocols[i+1], true
+		}
+	}
+	return "", false
+}
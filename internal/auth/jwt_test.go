@@ -0,0 +1,207 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jibitesh/request-response-manager/internal/config"
+)
+
+const testSecret = "jwt-test-secret"
+
+type testKeys struct {
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+}
+
+func newTestVerifier(t *testing.T) (*Verifier, *testKeys) {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	var cfg config.Config
+	cfg.Auth.JWT.Algorithms = []string{AlgHS256, AlgRS256, AlgES256}
+	cfg.Auth.JWT.Secret = testSecret
+	cfg.Auth.JWT.PublicKeyFiles = []string{
+		writePublicKey(t, dir, "rsa", &rsaKey.PublicKey),
+		writePublicKey(t, dir, "ec", &ecKey.PublicKey),
+	}
+	cfg.Auth.JWT.Issuer = "rrm-test"
+	cfg.Auth.JWT.Audience = "clients"
+	cfg.Auth.JWT.Leeway = 30 * time.Second
+	v, err := NewVerifier(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v, &testKeys{rsa: rsaKey, ec: ecKey}
+}
+
+func writePublicKey(t *testing.T, dir, name string, key crypto.PublicKey) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, name+".pem")
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// sign builds a token whose header names alg and signs it with signer.
+func sign(t *testing.T, alg string, claims Claims, signer func(input []byte) []byte) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return input + "." + base64.RawURLEncoding.EncodeToString(signer([]byte(input)))
+}
+
+func hs256(secret string) func([]byte) []byte {
+	return func(input []byte) []byte {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(input)
+		return mac.Sum(nil)
+	}
+}
+
+func rs256(t *testing.T, key *rsa.PrivateKey) func([]byte) []byte {
+	return func(input []byte) []byte {
+		digest := sha256.Sum256(input)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+}
+
+func es256(t *testing.T, key *ecdsa.PrivateKey) func([]byte) []byte {
+	return func(input []byte) []byte {
+		digest := sha256.Sum256(input)
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig
+	}
+}
+
+func unsigned([]byte) []byte {
+	return nil
+}
+
+func TestVerify(t *testing.T) {
+	v, keys := newTestVerifier(t)
+	now := time.Now()
+	valid := func() Claims {
+		return Claims{
+			"sub": "user-1",
+			"iss": "rrm-test",
+			"aud": "clients",
+			"exp": float64(now.Add(time.Hour).Unix()),
+			"nbf": float64(now.Add(-time.Minute).Unix()),
+		}
+	}
+	with := func(name string, value interface{}) Claims {
+		c := valid()
+		if value == nil {
+			delete(c, name)
+		} else {
+			c[name] = value
+		}
+		return c
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{"hs256", sign(t, AlgHS256, valid(), hs256(testSecret)), nil},
+		{"rs256", sign(t, AlgRS256, valid(), rs256(t, keys.rsa)), nil},
+		{"es256", sign(t, AlgES256, valid(), es256(t, keys.ec)), nil},
+		{"hs256 wrong secret", sign(t, AlgHS256, valid(), hs256("other")), ErrInvalidToken},
+		{"rs256 header signed with es256 key", sign(t, AlgRS256, valid(), es256(t, keys.ec)), ErrInvalidToken},
+		{"es256 header signed with rs256 key", sign(t, AlgES256, valid(), rs256(t, keys.rsa)), ErrInvalidToken},
+		{"rs256 header signed with secret", sign(t, AlgRS256, valid(), hs256(testSecret)), ErrInvalidToken},
+		{"alg none", sign(t, "none", valid(), unsigned), ErrInvalidToken},
+		{"alg not allowed", sign(t, "HS512", valid(), hs256(testSecret)), ErrInvalidToken},
+		{"expired", sign(t, AlgHS256, with("exp", float64(now.Add(-time.Minute).Unix())), hs256(testSecret)), ErrTokenExpired},
+		{"expired within leeway", sign(t, AlgHS256, with("exp", float64(now.Add(-10*time.Second).Unix())), hs256(testSecret)), nil},
+		{"no exp", sign(t, AlgHS256, with("exp", nil), hs256(testSecret)), nil},
+		{"not valid yet", sign(t, AlgHS256, with("nbf", float64(now.Add(time.Minute).Unix())), hs256(testSecret)), ErrInvalidToken},
+		{"nbf within leeway", sign(t, AlgHS256, with("nbf", float64(now.Add(10*time.Second).Unix())), hs256(testSecret)), nil},
+		{"wrong issuer", sign(t, AlgHS256, with("iss", "someone-else"), hs256(testSecret)), ErrInvalidToken},
+		{"no issuer", sign(t, AlgHS256, with("iss", nil), hs256(testSecret)), ErrInvalidToken},
+		{"wrong audience", sign(t, AlgHS256, with("aud", "admins"), hs256(testSecret)), ErrInvalidToken},
+		{"audience list", sign(t, AlgHS256, with("aud", []interface{}{"admins", "clients"}), hs256(testSecret)), nil},
+		{"audience list without ours", sign(t, AlgHS256, with("aud", []interface{}{"admins"}), hs256(testSecret)), ErrInvalidToken},
+		{"two segments", "a.b", ErrInvalidToken},
+		{"bad header", "!!!.e30.sig", ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := v.Verify(tt.token)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("Verify() error = %v, want none", err)
+				}
+				if claims.String("sub") != "user-1" {
+					t.Errorf("sub = %q, want user-1", claims.String("sub"))
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyTamperedPayload(t *testing.T) {
+	v, _ := newTestVerifier(t)
+	token := sign(t, AlgHS256, Claims{"sub": "user-1", "iss": "rrm-test", "aud": "clients"}, hs256(testSecret))
+	forged, _ := json.Marshal(Claims{"sub": "admin", "iss": "rrm-test", "aud": "clients"})
+	parts := strings.Split(token, ".")
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString(forged) + "." + parts[2]
+	if _, err := v.Verify(tampered); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("Verify() error = %v, want %v", err, ErrInvalidToken)
+	}
+}
+
+func TestNewVerifierRequiresSecretForHS256(t *testing.T) {
+	var cfg config.Config
+	cfg.Auth.JWT.Algorithms = []string{AlgHS256}
+	if _, err := NewVerifier(&cfg); err == nil {
+		t.Fatal("NewVerifier() without a secret succeeded")
+	}
+}
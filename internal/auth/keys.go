@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// keySet holds the public keys tokens may be signed with, by key id.
+type keySet struct {
+	byKid map[string]crypto.PublicKey
+	all   []crypto.PublicKey
+}
+
+// candidates returns the key named kid when it is known, otherwise every key.
+func (ks *keySet) candidates(kid string) []crypto.PublicKey {
+	if key, ok := ks.byKid[kid]; ok && kid != "" {
+		return []crypto.PublicKey{key}
+	}
+	return ks.all
+}
+
+func (ks *keySet) add(kid string, key crypto.PublicKey) {
+	if kid != "" {
+		ks.byKid[kid] = key
+	}
+	ks.all = append(ks.all, key)
+}
+
+// loadKeys reads PEM public keys or certificates, whose key id is the file
+// name without extension, and the keys of a local JWKS file.
+func loadKeys(pemFiles []string, jwksFile string) (*keySet, error) {
+	ks := &keySet{byKid: make(map[string]crypto.PublicKey)}
+	for _, file := range pemFiles {
+		key, err := loadPEM(file)
+		if err != nil {
+			return nil, fmt.Errorf("auth: load key %s: %w", file, err)
+		}
+		ks.add(strings.TrimSuffix(filepath.Base(file), filepath.Ext(file)), key)
+	}
+	if jwksFile != "" {
+		if err := loadJWKS(ks, jwksFile); err != nil {
+			return nil, fmt.Errorf("auth: load jwks %s: %w", jwksFile, err)
+		}
+	}
+	return ks, nil
+}
+
+func loadPEM(file string) (crypto.PublicKey, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block")
+	}
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	}
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func loadJWKS(ks *keySet, file string) error {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return err
+	}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return fmt.Errorf("key %q: %w", k.Kid, err)
+		}
+		ks.add(k.Kid, key)
+	}
+	return nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,201 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jibitesh/request-response-manager/internal/config"
+	"github.com/jibitesh/request-response-manager/internal/logger"
+	"github.com/jibitesh/request-response-manager/internal/store"
+)
+
+const (
+	ScopeSend   = "send"
+	ScopeLookup = "lookup"
+	ScopeAdmin  = "admin"
+	// ScopePeer guards the /internal endpoints. Only the peer credential
+	// holds it, and admin does not grant it.
+	ScopePeer = "peer"
+)
+
+const (
+	HeaderAPIKey     = "X-Api-Key"
+	HeaderClientId   = "X-Client-Id"
+	HeaderTimestamp  = "X-Timestamp"
+	HeaderNonce      = "X-Nonce"
+	HeaderSignature  = "X-Signature"
+	maxSignedBodyLen = 10 << 20
+)
+
+var (
+	ErrMissingCredentials = errors.New("auth: missing credentials")
+	ErrUnknownCredential  = errors.New("auth: unknown credential")
+	ErrBadSignature       = errors.New("auth: bad signature")
+	ErrStaleRequest       = errors.New("auth: request timestamp outside allowed skew")
+	ErrReplayedNonce      = errors.New("auth: nonce already used")
+)
+
+type credential struct {
+	id     string
+	key    string
+	secret []byte
+	scopes map[string]bool
+}
+
+// allows reports whether the credential grants scope. admin grants every
+// scope but peer.
+func (c *credential) allows(scope string) bool {
+	return c.scopes[scope] || (scope != ScopePeer && c.scopes[ScopeAdmin])
+}
+
+// ServiceAuthenticator checks the API key or HMAC signature of REST callers
+// and the scope of the credential they present.
+type ServiceAuthenticator struct {
+	enabled     bool
+	maxSkew     time.Duration
+	nonces      store.NonceStore
+	credentials map[string]*credential
+}
+
+func NewServiceAuthenticator(cfg *config.Config, nonces store.NonceStore) (*ServiceAuthenticator, error) {
+	svcCfg := cfg.Auth.Service
+	a := &ServiceAuthenticator{
+		enabled:     svcCfg.Enabled,
+		maxSkew:     svcCfg.MaxSkew,
+		nonces:      nonces,
+		credentials: make(map[string]*credential, len(svcCfg.Credentials)),
+	}
+	for _, c := range svcCfg.Credentials {
+		if c.Id == "" {
+			return nil, errors.New("auth: service credential without id")
+		}
+		if c.Key == "" && c.Secret == "" {
+			return nil, fmt.Errorf("auth: service credential %q has neither key nor secret", c.Id)
+		}
+		cred := &credential{id: c.Id, key: c.Key, secret: []byte(c.Secret), scopes: make(map[string]bool)}
+		for _, scope := range c.Scopes {
+			switch scope {
+			case ScopeSend, ScopeLookup, ScopeAdmin:
+				cred.scopes[scope] = true
+			default:
+				return nil, fmt.Errorf("auth: service credential %q has unknown scope %q", c.Id, scope)
+			}
+		}
+		if c.Id == svcCfg.PeerCredential {
+			if c.Secret == "" {
+				return nil, fmt.Errorf("auth: peer credential %q has no secret to sign with", c.Id)
+			}
+			cred.scopes[ScopePeer] = true
+		}
+		a.credentials[c.Id] = cred
+	}
+	if svcCfg.Enabled && a.credentials[svcCfg.PeerCredential] == nil {
+		return nil, fmt.Errorf("auth: peer credential %q is not configured", svcCfg.PeerCredential)
+	}
+	return a, nil
+}
+
+// Require wraps next so it only runs for callers whose credential grants scope.
+// When service auth is disabled next is returned unchanged.
+func (a *ServiceAuthenticator) Require(scope string, next http.HandlerFunc) http.HandlerFunc {
+	if !a.enabled {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		cred, err := a.authenticate(r)
+		if err != nil {
+			logger.Infof("auth: rejected %s %s from %s. Error: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !cred.allows(scope) {
+			logger.Infof("auth: denied %s %s to credential %s from %s: missing scope %s", r.Method, r.URL.Path, cred.id, r.RemoteAddr, scope)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		logger.Infof("auth: allowed %s %s to credential %s from %s with scope %s", r.Method, r.URL.Path, cred.id, r.RemoteAddr, scope)
+		next(w, r)
+	}
+}
+
+func (a *ServiceAuthenticator) authenticate(r *http.Request) (*credential, error) {
+	if key := r.Header.Get(HeaderAPIKey); key != "" {
+		for _, cred := range a.credentials {
+			if cred.key != "" && subtle.ConstantTimeCompare([]byte(cred.key), []byte(key)) == 1 {
+				return cred, nil
+			}
+		}
+		return nil, ErrUnknownCredential
+	}
+
+	id := r.Header.Get(HeaderClientId)
+	sig := r.Header.Get(HeaderSignature)
+	if id == "" || sig == "" {
+		return nil, ErrMissingCredentials
+	}
+	cred, ok := a.credentials[id]
+	if !ok || len(cred.secret) == 0 {
+		return nil, ErrUnknownCredential
+	}
+
+	ts, err := strconv.ParseInt(r.Header.Get(HeaderTimestamp), 10, 64)
+	if err != nil {
+		return nil, ErrStaleRequest
+	}
+	if skew := time.Since(time.Unix(ts, 0)); skew > a.maxSkew || skew < -a.maxSkew {
+		return nil, ErrStaleRequest
+	}
+	nonce := r.Header.Get(HeaderNonce)
+	if nonce == "" {
+		return nil, ErrMissingCredentials
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSignedBodyLen))
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	expected := signature(cred.secret, r.Method, r.URL.RequestURI(), r.Header.Get(HeaderTimestamp), nonce, body)
+	if !hmac.Equal([]byte(expected), []byte(sig)) {
+		return nil, ErrBadSignature
+	}
+
+	// The nonce only has to outlive the window in which its timestamp is accepted.
+	fresh, err := a.nonces.Claim(r.Context(), id, nonce, 2*a.maxSkew)
+	if err != nil {
+		return nil, fmt.Errorf("auth: claim nonce: %w", err)
+	}
+	if !fresh {
+		return nil, ErrReplayedNonce
+	}
+	return cred, nil
+}
+
+// Sign adds the HMAC headers for credential id to req, whose body is body.
+func Sign(req *http.Request, body []byte, id, secret string) {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := uuid.NewString()
+	req.Header.Set(HeaderClientId, id)
+	req.Header.Set(HeaderTimestamp, ts)
+	req.Header.Set(HeaderNonce, nonce)
+	req.Header.Set(HeaderSignature, signature([]byte(secret), req.Method, req.URL.RequestURI(), ts, nonce, body))
+}
+
+// signature is the hex HMAC-SHA256 of the method, request URI, timestamp,
+// nonce and body hash, separated by newlines.
+func signature(secret []byte, method, uri, ts, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s", method, uri, ts, nonce, hex.EncodeToString(bodyHash[:]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
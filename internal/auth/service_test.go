@@ -0,0 +1,314 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jibitesh/request-response-manager/internal/config"
+	"github.com/jibitesh/request-response-manager/internal/logger"
+)
+
+func TestMain(m *testing.M) {
+	config.AppConfig = &config.Config{}
+	config.AppConfig.Logger.Level = "fatal"
+	if err := logger.Init(); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// memoryNonces is a NonceStore that keeps claimed nonces in memory.
+type memoryNonces struct {
+	mu      sync.Mutex
+	claimed map[string]bool
+}
+
+func (n *memoryNonces) Claim(ctx context.Context, credentialId, nonce string, ttl time.Duration) (bool, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	key := credentialId + ":" + nonce
+	if n.claimed[key] {
+		return false, nil
+	}
+	n.claimed[key] = true
+	return true, nil
+}
+
+func serviceConfig(creds ...config.ServiceCredential) *config.Config {
+	var cfg config.Config
+	cfg.Auth.Service.Enabled = true
+	cfg.Auth.Service.MaxSkew = time.Minute
+	cfg.Auth.Service.PeerCredential = "cluster"
+	cfg.Auth.Service.Credentials = creds
+	return &cfg
+}
+
+func newTestAuthenticator(t *testing.T) *ServiceAuthenticator {
+	t.Helper()
+	a, err := NewServiceAuthenticator(serviceConfig(
+		config.ServiceCredential{Id: "cluster", Secret: "cluster-secret"},
+		config.ServiceCredential{Id: "sender", Secret: "sender-secret", Scopes: []string{ScopeSend}},
+		config.ServiceCredential{Id: "ops", Key: "ops-key", Scopes: []string{ScopeAdmin}},
+		config.ServiceCredential{Id: "reader", Key: "reader-key", Scopes: []string{ScopeLookup}},
+	), &memoryNonces{claimed: make(map[string]bool)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// signedRequest builds a request signed at ts whose body is sent, while the
+// signature covers signed.
+func signedRequest(id, secret string, ts time.Time, nonce string, signed, sent []byte) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/send?sessionId=s1", bytes.NewReader(sent))
+	unix := strconv.FormatInt(ts.Unix(), 10)
+	req.Header.Set(HeaderClientId, id)
+	req.Header.Set(HeaderTimestamp, unix)
+	req.Header.Set(HeaderNonce, nonce)
+	req.Header.Set(HeaderSignature, signature([]byte(secret), req.Method, req.URL.RequestURI(), unix, nonce, signed))
+	return req
+}
+
+func TestAuthenticate(t *testing.T) {
+	body := []byte(`{"message":"hello"}`)
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		req     func() *http.Request
+		wantId  string
+		wantErr error
+	}{
+		{
+			name:   "signed",
+			req:    func() *http.Request { return signedRequest("sender", "sender-secret", now, "n1", body, body) },
+			wantId: "sender",
+		},
+		{
+			name: "signed within skew",
+			req: func() *http.Request {
+				return signedRequest("sender", "sender-secret", now.Add(-50*time.Second), "n2", body, body)
+			},
+			wantId: "sender",
+		},
+		{
+			name: "body tampered",
+			req: func() *http.Request {
+				return signedRequest("sender", "sender-secret", now, "n3", body, []byte(`{"message":"bye"}`))
+			},
+			wantErr: ErrBadSignature,
+		},
+		{
+			name:    "wrong secret",
+			req:     func() *http.Request { return signedRequest("sender", "cluster-secret", now, "n4", body, body) },
+			wantErr: ErrBadSignature,
+		},
+		{
+			name: "timestamp too old",
+			req: func() *http.Request {
+				return signedRequest("sender", "sender-secret", now.Add(-2*time.Minute), "n5", body, body)
+			},
+			wantErr: ErrStaleRequest,
+		},
+		{
+			name: "timestamp in the future",
+			req: func() *http.Request {
+				return signedRequest("sender", "sender-secret", now.Add(2*time.Minute), "n6", body, body)
+			},
+			wantErr: ErrStaleRequest,
+		},
+		{
+			name: "timestamp missing",
+			req: func() *http.Request {
+				req := signedRequest("sender", "sender-secret", now, "n7", body, body)
+				req.Header.Del(HeaderTimestamp)
+				return req
+			},
+			wantErr: ErrStaleRequest,
+		},
+		{
+			name: "nonce missing",
+			req: func() *http.Request {
+				req := signedRequest("sender", "sender-secret", now, "n8", body, body)
+				req.Header.Del(HeaderNonce)
+				return req
+			},
+			wantErr: ErrMissingCredentials,
+		},
+		{
+			name:    "unknown client",
+			req:     func() *http.Request { return signedRequest("stranger", "sender-secret", now, "n9", body, body) },
+			wantErr: ErrUnknownCredential,
+		},
+		{
+			name:    "key-only credential cannot sign",
+			req:     func() *http.Request { return signedRequest("ops", "", now, "n10", body, body) },
+			wantErr: ErrUnknownCredential,
+		},
+		{
+			name:    "no credentials",
+			req:     func() *http.Request { return httptest.NewRequest(http.MethodPost, "/send", bytes.NewReader(body)) },
+			wantErr: ErrMissingCredentials,
+		},
+		{
+			name: "api key",
+			req: func() *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "/send", bytes.NewReader(body))
+				req.Header.Set(HeaderAPIKey, "ops-key")
+				return req
+			},
+			wantId: "ops",
+		},
+		{
+			name: "unknown api key",
+			req: func() *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "/send", bytes.NewReader(body))
+				req.Header.Set(HeaderAPIKey, "guess")
+				return req
+			},
+			wantErr: ErrUnknownCredential,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestAuthenticator(t)
+			req := tt.req()
+			cred, err := a.authenticate(req)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("authenticate() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("authenticate() error = %v, want none", err)
+			}
+			if cred.id != tt.wantId {
+				t.Errorf("credential = %s, want %s", cred.id, tt.wantId)
+			}
+			// The handler must still be able to read the signed body.
+			if got, _ := io.ReadAll(req.Body); !bytes.Equal(got, body) {
+				t.Errorf("body after authenticate = %q, want %q", got, body)
+			}
+		})
+	}
+}
+
+func TestAuthenticateRejectsReplayedNonce(t *testing.T) {
+	a := newTestAuthenticator(t)
+	body := []byte(`{}`)
+	now := time.Now()
+	if _, err := a.authenticate(signedRequest("sender", "sender-secret", now, "once", body, body)); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	if _, err := a.authenticate(signedRequest("sender", "sender-secret", now, "once", body, body)); !errors.Is(err, ErrReplayedNonce) {
+		t.Fatalf("replayed request error = %v, want %v", err, ErrReplayedNonce)
+	}
+	// Nonces are tracked per credential.
+	if _, err := a.authenticate(signedRequest("cluster", "cluster-secret", now, "once", body, body)); err != nil {
+		t.Fatalf("same nonce from another credential: %v", err)
+	}
+}
+
+func TestSignRoundTrip(t *testing.T) {
+	a := newTestAuthenticator(t)
+	body := []byte(`{"sessionId":"s1"}`)
+	req := httptest.NewRequest(http.MethodPost, "/internal/deliver", bytes.NewReader(body))
+	Sign(req, body, "cluster", "cluster-secret")
+	cred, err := a.authenticate(req)
+	if err != nil {
+		t.Fatalf("authenticate() error = %v", err)
+	}
+	if cred.id != "cluster" {
+		t.Errorf("credential = %s, want cluster", cred.id)
+	}
+}
+
+func TestRequire(t *testing.T) {
+	apiKey := func(key string) func(*http.Request) {
+		return func(req *http.Request) { req.Header.Set(HeaderAPIKey, key) }
+	}
+	signed := func(id, secret string) func(*http.Request) {
+		return func(req *http.Request) { Sign(req, nil, id, secret) }
+	}
+
+	tests := []struct {
+		name   string
+		scope  string
+		auth   func(*http.Request)
+		status int
+	}{
+		{"send with send scope", ScopeSend, signed("sender", "sender-secret"), http.StatusOK},
+		{"lookup without lookup scope", ScopeLookup, signed("sender", "sender-secret"), http.StatusForbidden},
+		{"lookup with lookup scope", ScopeLookup, apiKey("reader-key"), http.StatusOK},
+		{"admin grants send", ScopeSend, apiKey("ops-key"), http.StatusOK},
+		{"admin grants lookup", ScopeLookup, apiKey("ops-key"), http.StatusOK},
+		{"admin does not grant peer", ScopePeer, apiKey("ops-key"), http.StatusForbidden},
+		{"send does not grant peer", ScopePeer, signed("sender", "sender-secret"), http.StatusForbidden},
+		{"peer credential has peer", ScopePeer, signed("cluster", "cluster-secret"), http.StatusOK},
+		{"peer credential has nothing else", ScopeSend, signed("cluster", "cluster-secret"), http.StatusForbidden},
+		{"unauthenticated", ScopeSend, func(*http.Request) {}, http.StatusUnauthorized},
+		{"bad key", ScopeSend, apiKey("guess"), http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestAuthenticator(t)
+			called := false
+			h := a.Require(tt.scope, func(w http.ResponseWriter, r *http.Request) { called = true })
+			req := httptest.NewRequest(http.MethodGet, "/resource", nil)
+			tt.auth(req)
+			rec := httptest.NewRecorder()
+			h(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if called != (tt.status == http.StatusOK) {
+				t.Errorf("handler called = %v with status %d", called, rec.Code)
+			}
+		})
+	}
+}
+
+func TestRequireDisabled(t *testing.T) {
+	cfg := serviceConfig()
+	cfg.Auth.Service.Enabled = false
+	a, err := NewServiceAuthenticator(cfg, &memoryNonces{claimed: make(map[string]bool)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	a.Require(ScopePeer, func(w http.ResponseWriter, r *http.Request) {})(rec, httptest.NewRequest(http.MethodGet, "/internal/ack", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestNewServiceAuthenticatorRejects(t *testing.T) {
+	tests := []struct {
+		name  string
+		creds []config.ServiceCredential
+	}{
+		{"missing peer credential", []config.ServiceCredential{{Id: "sender", Secret: "s", Scopes: []string{ScopeSend}}}},
+		{"peer credential without secret", []config.ServiceCredential{{Id: "cluster", Key: "k"}}},
+		{"peer scope granted by config", []config.ServiceCredential{{Id: "cluster", Secret: "s"}, {Id: "sender", Secret: "s", Scopes: []string{ScopePeer}}}},
+		{"unknown scope", []config.ServiceCredential{{Id: "cluster", Secret: "s"}, {Id: "sender", Secret: "s", Scopes: []string{"write"}}}},
+		{"credential without id", []config.ServiceCredential{{Id: "cluster", Secret: "s"}, {Secret: "s"}}},
+		{"credential without key or secret", []config.ServiceCredential{{Id: "cluster", Secret: "s"}, {Id: "sender"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewServiceAuthenticator(serviceConfig(tt.creds...), &memoryNonces{claimed: make(map[string]bool)}); err == nil {
+				t.Fatal("NewServiceAuthenticator() succeeded")
+			}
+		})
+	}
+}
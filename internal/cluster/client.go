@@ -0,0 +1,79 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jibitesh/request-response-manager/internal/auth"
+	"github.com/jibitesh/request-response-manager/internal/config"
+	"github.com/jibitesh/request-response-manager/pkg/instance"
+)
+
+var ErrUnreachable = errors.New("cluster: peer instance unreachable")
+
+// Client calls the /internal endpoints of peer instances. When service auth
+// is enabled requests are signed with the configured peer credential.
+type Client struct {
+	httpClient   *http.Client
+	timeout      time.Duration
+	credentialId string
+	secret       string
+}
+
+func NewClient(cfg *config.Config) *Client {
+	c := &Client{
+		httpClient: &http.Client{},
+		timeout:    cfg.Cluster.ForwardTimeout,
+	}
+	if cfg.Auth.Service.Enabled {
+		for _, cred := range cfg.Auth.Service.Credentials {
+			if cred.Id == cfg.Auth.Service.PeerCredential {
+				c.credentialId, c.secret = cred.Id, cred.Secret
+			}
+		}
+	}
+	return c
+}
+
+// Post sends in as JSON to path on the peer and decodes the JSON response into out.
+// Any response from the peer, whatever its status, is returned with a nil error so
+// callers can map it; transport failures are reported as ErrUnreachable.
+// The forward timeout applies unless ctx already carries a deadline.
+func (c *Client) Post(ctx context.Context, peer *instance.Instance, path string, in, out interface{}) (int, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	b, err := json.Marshal(in)
+	if err != nil {
+		return 0, err
+	}
+	url := fmt.Sprintf("http://%s%s", peer.Addr(), path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.secret != "" {
+		auth.Sign(req, b, c.credentialId, c.secret)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s: %v", ErrUnreachable, peer.Addr(), err)
+	}
+	defer resp.Body.Close()
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, fmt.Errorf("cluster: decode response from %s: %w", peer.Addr(), err)
+		}
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,143 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jibitesh/request-response-manager/internal/config"
+	"github.com/jibitesh/request-response-manager/internal/logger"
+	"github.com/jibitesh/request-response-manager/internal/store"
+	"github.com/jibitesh/request-response-manager/pkg/instance"
+)
+
+// Heartbeat keeps this instance registered in the instance registry until
+// stopped. If the instance misses enough beats for a reaper to claim it as
+// dead, the next beat registers it again and calls reaped, since its sessions
+// are being deleted by then.
+type Heartbeat struct {
+	registry    store.InstanceRegistry
+	instance    *instance.Instance
+	interval    time.Duration
+	ttl         time.Duration
+	startedAt   time.Time
+	connections func() int
+	reaped      func()
+	mu          sync.Mutex
+	lastBeat    time.Time
+	lastErr     error
+	stop        chan struct{}
+	done        chan struct{}
+	stopOnce    sync.Once
+}
+
+func NewHeartbeat(cfg *config.Config, registry store.InstanceRegistry, instance *instance.Instance, connections func() int, reaped func()) *Heartbeat {
+	return &Heartbeat{
+		registry:    registry,
+		instance:    instance,
+		interval:    cfg.Instance.HeartbeatInterval,
+		ttl:         cfg.Instance.HeartbeatTTL,
+		startedAt:   time.Now(),
+		connections: connections,
+		reaped:      reaped,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// Start registers the instance and keeps heartbeating in the background. A
+// failed first beat is returned but later beats keep retrying.
+func (h *Heartbeat) Start() error {
+	err := h.beat()
+	go h.run()
+	return err
+}
+
+func (h *Heartbeat) run() {
+	defer close(h.done)
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := h.beat(); err != nil {
+				logger.Errorf("Failed to send heartbeat for instance: %s. Error: %v", h.instance.Name, err)
+			}
+		case <-h.stop:
+			return
+		}
+	}
+}
+
+func (h *Heartbeat) beat() error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.interval)
+	defer cancel()
+	now := time.Now()
+	added, err := h.registry.Register(ctx, &store.InstanceInfo{
+		Instance:    *h.instance,
+		Version:     instance.Version,
+		StartedAt:   h.startedAt,
+		Connections: h.connections(),
+		HeartbeatAt: now,
+	}, h.ttl)
+
+	h.mu.Lock()
+	registered := !h.lastBeat.IsZero()
+	if err == nil {
+		h.lastBeat = now
+	}
+	h.lastErr = err
+	h.mu.Unlock()
+
+	if added && registered {
+		logger.Infof("Instance: %s was reaped after missing heartbeats, registered again", h.instance.Name)
+		h.reaped()
+	}
+	return err
+}
+
+// Status returns when the instance last registered itself and the error of
+// the latest heartbeat, if it failed.
+func (h *Heartbeat) Status() (time.Time, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.lastBeat, h.lastErr
+}
+
+// StartedAt is when this instance started.
+func (h *Heartbeat) StartedAt() time.Time {
+	return h.startedAt
+}
+
+// Stop ends the heartbeat and removes this instance from the registry.
+func (h *Heartbeat) Stop(ctx context.Context) error {
+	h.stopOnce.Do(func() { close(h.stop) })
+	select {
+	case <-h.done:
+	case <-ctx.Done():
+	}
+	return h.registry.Deregister(ctx, h.instance.Name)
+}
+
+func InstancesHandler(registry store.InstanceRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		infos, err := registry.List(r.Context())
+		if err != nil {
+			logger.Errorf("Failed to list instances. Error: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if infos == nil {
+			infos = []*store.InstanceInfo{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(infos)
+	}
+}
@@ -0,0 +1,73 @@
+package cluster
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jibitesh/request-response-manager/internal/config"
+	"github.com/jibitesh/request-response-manager/internal/logger"
+	"github.com/jibitesh/request-response-manager/internal/store"
+)
+
+// Reaper removes the sessions of instances whose heartbeat has expired.
+type Reaper struct {
+	registry       store.InstanceRegistry
+	sessionService *store.SessionService
+	interval       time.Duration
+	stop           chan struct{}
+	stopOnce       sync.Once
+}
+
+func NewReaper(cfg *config.Config, registry store.InstanceRegistry, sessionService *store.SessionService) *Reaper {
+	return &Reaper{
+		registry:       registry,
+		sessionService: sessionService,
+		interval:       cfg.Instance.ReapInterval,
+		stop:           make(chan struct{}),
+	}
+}
+
+func (r *Reaper) Start() {
+	go r.run()
+}
+
+func (r *Reaper) Stop() {
+	r.stopOnce.Do(func() { close(r.stop) })
+}
+
+func (r *Reaper) run() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), r.interval)
+			r.Reap(ctx)
+			cancel()
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// Reap claims every dead instance and removes its sessions. It returns the
+// total number of sessions cleaned up.
+func (r *Reaper) Reap(ctx context.Context) int {
+	dead, err := r.registry.ClaimDead(ctx)
+	if err != nil {
+		logger.Errorf("Failed to find dead instances. Error: %v", err)
+	}
+	total := 0
+	for _, name := range dead {
+		n, err := r.sessionService.ReapInstance(ctx, name)
+		if err != nil {
+			logger.Errorf("Failed to reap sessions of dead instance: %s. Error: %v", name, err)
+			continue
+		}
+		logger.Infof("Reaped %d sessions of dead instance: %s", n, name)
+		total += n
+	}
+	return total
+}
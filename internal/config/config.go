@@ -23,6 +23,126 @@ type Config struct {
 		OutputPaths      []string `mapstructure:"outputPaths"`
 		ErrorOutputPaths []string `mapstructure:"errorOutputPaths"`
 	} `mapstructure:"logger"`
+	Instance struct {
+		Id                string        `mapstructure:"id"`
+		HeartbeatInterval time.Duration `mapstructure:"heartbeatInterval"`
+		HeartbeatTTL      time.Duration `mapstructure:"heartbeatTTL"`
+		ReapInterval      time.Duration `mapstructure:"reapInterval"`
+	} `mapstructure:"instance"`
+	Cluster struct {
+		ForwardTimeout time.Duration `mapstructure:"forwardTimeout"`
+	} `mapstructure:"cluster"`
+	Auth struct {
+		UserHeader string `mapstructure:"userHeader"`
+		JWT        struct {
+			Enabled        bool          `mapstructure:"enabled"`
+			Algorithms     []string      `mapstructure:"algorithms"`
+			Secret         string        `mapstructure:"secret"`
+			SecretFile     string        `mapstructure:"secretFile"`
+			PublicKeyFiles []string      `mapstructure:"publicKeyFiles"`
+			JWKSFile       string        `mapstructure:"jwksFile"`
+			Issuer         string        `mapstructure:"issuer"`
+			Audience       string        `mapstructure:"audience"`
+			Leeway         time.Duration `mapstructure:"leeway"`
+			QueryParam     string        `mapstructure:"queryParam"`
+			UserClaim      string        `mapstructure:"userClaim"`
+			Claims         []string      `mapstructure:"claims"`
+		} `mapstructure:"jwt"`
+		Service struct {
+			Enabled        bool                `mapstructure:"enabled"`
+			MaxSkew        time.Duration       `mapstructure:"maxSkew"`
+			PeerCredential string              `mapstructure:"peerCredential"`
+			Credentials    []ServiceCredential `mapstructure:"credentials"`
+		} `mapstructure:"service"`
+	} `mapstructure:"auth"`
+	Connection struct {
+		AllowedOrigins []string      `mapstructure:"allowedOrigins"`
+		Subprotocols   []string      `mapstructure:"subprotocols"`
+		QueueSize      int           `mapstructure:"queueSize"`
+		Overflow       string        `mapstructure:"overflow"`
+		WriteTimeout   time.Duration `mapstructure:"writeTimeout"`
+		BlockTimeout   time.Duration `mapstructure:"blockTimeout"`
+		PingInterval   time.Duration `mapstructure:"pingInterval"`
+		PongTimeout    time.Duration `mapstructure:"pongTimeout"`
+		IdleTimeout    time.Duration `mapstructure:"idleTimeout"`
+		TTLRefresh     time.Duration `mapstructure:"ttlRefresh"`
+		MaxConnections int           `mapstructure:"maxConnections"`
+	} `mapstructure:"connection"`
+	Health struct {
+		PingTimeout time.Duration `mapstructure:"pingTimeout"`
+	} `mapstructure:"health"`
+	Drain struct {
+		Timeout         time.Duration `mapstructure:"timeout"`
+		ReconnectDelay  time.Duration `mapstructure:"reconnectDelay"`
+		ReconnectJitter time.Duration `mapstructure:"reconnectJitter"`
+	} `mapstructure:"drain"`
+	Admin struct {
+		PageSize    int `mapstructure:"pageSize"`
+		MaxPageSize int `mapstructure:"maxPageSize"`
+	} `mapstructure:"admin"`
+	Session struct {
+		ResumeGrace      time.Duration `mapstructure:"resumeGrace"`
+		ReplayBufferSize int           `mapstructure:"replayBufferSize"`
+	} `mapstructure:"session"`
+	Request struct {
+		Timeout    time.Duration `mapstructure:"timeout"`
+		MaxTimeout time.Duration `mapstructure:"maxTimeout"`
+	} `mapstructure:"request"`
+	Poll struct {
+		Timeout      time.Duration `mapstructure:"timeout"`
+		MaxTimeout   time.Duration `mapstructure:"maxTimeout"`
+		IdleTimeout  time.Duration `mapstructure:"idleTimeout"`
+		MaxBatch     int           `mapstructure:"maxBatch"`
+		MaxFrameSize int64         `mapstructure:"maxFrameSize"`
+	} `mapstructure:"poll"`
+	Batch struct {
+		MaxSize int `mapstructure:"maxSize"`
+	} `mapstructure:"batch"`
+	Ack struct {
+		Timeout         time.Duration `mapstructure:"timeout"`
+		MaxTimeout      time.Duration `mapstructure:"maxTimeout"`
+		RetryInterval   time.Duration `mapstructure:"retryInterval"`
+		MaxRetries      int           `mapstructure:"maxRetries"`
+		CallbackTimeout time.Duration `mapstructure:"callbackTimeout"`
+		CallbackHosts   []string      `mapstructure:"callbackHosts"`
+	} `mapstructure:"ack"`
+	Mailbox struct {
+		Enabled bool          `mapstructure:"enabled"`
+		TTL     time.Duration `mapstructure:"ttl"`
+		MaxTTL  time.Duration `mapstructure:"maxTtl"`
+		MaxSize int           `mapstructure:"maxSize"`
+	} `mapstructure:"mailbox"`
+	Message struct {
+		Format string `mapstructure:"format"`
+	} `mapstructure:"message"`
+	Upstream struct {
+		RouteField string `mapstructure:"routeField"`
+		// QueueSize is how many of a session's messages may wait to be
+		// dispatched upstream, in order, before further ones are dropped.
+		QueueSize int             `mapstructure:"queueSize"`
+		Routes    []UpstreamRoute `mapstructure:"routes"`
+	} `mapstructure:"upstream"`
+}
+
+// UpstreamRoute sends client messages whose route field equals Match to URL.
+// A route with Match "*" catches messages no other route matched.
+type UpstreamRoute struct {
+	Name          string        `mapstructure:"name"`
+	Match         string        `mapstructure:"match"`
+	URL           string        `mapstructure:"url"`
+	Timeout       time.Duration `mapstructure:"timeout"`
+	Retries       int           `mapstructure:"retries"`
+	RetryBackoff  time.Duration `mapstructure:"retryBackoff"`
+	ReplyToClient bool          `mapstructure:"replyToClient"`
+}
+
+// ServiceCredential lets a service call the REST API with the static Key or
+// with requests signed by Secret. Scopes are send, lookup and admin.
+type ServiceCredential struct {
+	Id     string   `mapstructure:"id"`
+	Key    string   `mapstructure:"key"`
+	Secret string   `mapstructure:"secret"`
+	Scopes []string `mapstructure:"scopes"`
 }
 
 var AppConfig *Config
@@ -33,6 +153,7 @@ func LoadConfig() error {
 	viper.SetConfigType("yaml")
 	viper.SetEnvPrefix("APP")
 	viper.AutomaticEnv()
+	setDefaults()
 
 	// Load base config
 	if err := viper.ReadInConfig(); err != nil {
@@ -67,3 +188,52 @@ func LoadConfig() error {
 	}
 	return nil
 }
+
+func setDefaults() {
+	viper.SetDefault("instance.heartbeatInterval", 5*time.Second)
+	viper.SetDefault("instance.heartbeatTTL", 15*time.Second)
+	viper.SetDefault("instance.reapInterval", 30*time.Second)
+	viper.SetDefault("cluster.forwardTimeout", 5*time.Second)
+	viper.SetDefault("auth.userHeader", "")
+	viper.SetDefault("auth.jwt.algorithms", []string{"RS256", "ES256"})
+	viper.SetDefault("auth.jwt.leeway", 30*time.Second)
+	viper.SetDefault("auth.jwt.queryParam", "access_token")
+	viper.SetDefault("auth.jwt.userClaim", "sub")
+	viper.SetDefault("auth.service.maxSkew", 5*time.Minute)
+	viper.SetDefault("connection.queueSize", 256)
+	viper.SetDefault("connection.overflow", "block")
+	viper.SetDefault("connection.writeTimeout", 10*time.Second)
+	viper.SetDefault("connection.blockTimeout", 5*time.Second)
+	viper.SetDefault("connection.pingInterval", 10*time.Second)
+	viper.SetDefault("connection.pongTimeout", 10*time.Second)
+	viper.SetDefault("connection.idleTimeout", 0)
+	viper.SetDefault("connection.ttlRefresh", time.Minute)
+	viper.SetDefault("connection.maxConnections", 0)
+	viper.SetDefault("health.pingTimeout", time.Second)
+	viper.SetDefault("drain.timeout", 20*time.Second)
+	viper.SetDefault("drain.reconnectDelay", time.Second)
+	viper.SetDefault("drain.reconnectJitter", 5*time.Second)
+	viper.SetDefault("admin.pageSize", 100)
+	viper.SetDefault("admin.maxPageSize", 1000)
+	viper.SetDefault("session.resumeGrace", 30*time.Second)
+	viper.SetDefault("session.replayBufferSize", 100)
+	viper.SetDefault("request.timeout", 30*time.Second)
+	viper.SetDefault("request.maxTimeout", 2*time.Minute)
+	viper.SetDefault("poll.timeout", 25*time.Second)
+	viper.SetDefault("poll.maxTimeout", time.Minute)
+	viper.SetDefault("poll.idleTimeout", time.Minute)
+	viper.SetDefault("poll.maxBatch", 100)
+	viper.SetDefault("poll.maxFrameSize", 1<<20)
+	viper.SetDefault("batch.maxSize", 10000)
+	viper.SetDefault("ack.timeout", 30*time.Second)
+	viper.SetDefault("ack.maxTimeout", 5*time.Minute)
+	viper.SetDefault("ack.retryInterval", 5*time.Second)
+	viper.SetDefault("ack.maxRetries", 5)
+	viper.SetDefault("ack.callbackTimeout", 5*time.Second)
+	viper.SetDefault("mailbox.ttl", time.Hour)
+	viper.SetDefault("mailbox.maxTtl", 24*time.Hour)
+	viper.SetDefault("mailbox.maxSize", 1000)
+	viper.SetDefault("message.format", "envelope")
+	viper.SetDefault("upstream.routeField", "type")
+	viper.SetDefault("upstream.queueSize", 64)
+}
@@ -0,0 +1,179 @@
+package message
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Version is the envelope version written by this build. Envelopes with a
+// higher version are rejected so older instances never half-understand them.
+const Version = 1
+
+const (
+	TypeMessage     = "message"
+	TypeRequest     = "request"
+	TypeResponse    = "response"
+	TypeSession     = "session"
+	TypeSubscribe   = "subscribe"
+	TypeUnsubscribe = "unsubscribe"
+	TypeAck         = "ack"
+)
+
+const (
+	FormatEnvelope = "envelope"
+	FormatRaw      = "raw"
+)
+
+// Headers describing the payload. Binary payloads are carried as a base64
+// JSON string and marked with the base64 content encoding.
+const (
+	HeaderContentType     = "content-type"
+	HeaderContentEncoding = "content-encoding"
+	EncodingBase64        = "base64"
+	ContentTypeBinary     = "application/octet-stream"
+)
+
+var (
+	ErrNotEnvelope        = errors.New("message: not an envelope")
+	ErrUnsupportedVersion = fmt.Errorf("message: unsupported envelope version, max %d", Version)
+	ErrInvalidBinary      = errors.New("message: binary payload is not a base64 string")
+)
+
+type Envelope struct {
+	Version       int    `json:"version"`
+	Id            string `json:"id"`
+	Type          string `json:"type"`
+	CorrelationId string `json:"correlationId,omitempty"`
+	// Ack asks the client to answer with an ack envelope correlated to Id.
+	Ack     bool              `json:"ack,omitempty"`
+	Ts      int64             `json:"ts"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Payload json.RawMessage   `json:"payload,omitempty"`
+}
+
+func New(typ string, payload json.RawMessage) *Envelope {
+	return &Envelope{
+		Version: Version,
+		Id:      uuid.NewString(),
+		Type:    typ,
+		Ts:      time.Now().UnixMilli(),
+		Payload: payload,
+	}
+}
+
+// FromText wraps a legacy plain-text message as a message envelope.
+func FromText(text string) *Envelope {
+	payload, _ := json.Marshal(text)
+	return New(TypeMessage, payload)
+}
+
+// NewBinary wraps data as a message envelope. An empty content type means
+// application/octet-stream.
+func NewBinary(data []byte, contentType string) *Envelope {
+	if contentType == "" {
+		contentType = ContentTypeBinary
+	}
+	payload, _ := json.Marshal(data)
+	env := New(TypeMessage, payload)
+	env.Headers = map[string]string{
+		HeaderContentType:     contentType,
+		HeaderContentEncoding: EncodingBase64,
+	}
+	return env
+}
+
+// IsBinary reports whether the payload is base64-encoded binary data.
+func (e *Envelope) IsBinary() bool {
+	return e.Headers[HeaderContentEncoding] == EncodingBase64
+}
+
+func (e *Envelope) ContentType() string {
+	return e.Headers[HeaderContentType]
+}
+
+// SetContentType records the media type of the payload.
+func (e *Envelope) SetContentType(contentType string) {
+	if e.Headers == nil {
+		e.Headers = make(map[string]string)
+	}
+	e.Headers[HeaderContentType] = contentType
+}
+
+// Data returns the decoded payload of a binary envelope.
+func (e *Envelope) Data() ([]byte, error) {
+	var data []byte
+	if err := json.Unmarshal(e.Payload, &data); err != nil {
+		return nil, ErrInvalidBinary
+	}
+	return data, nil
+}
+
+// Parse decodes b as an envelope. Frames without a version field are not
+// envelopes and yield ErrNotEnvelope so callers can fall back to raw handling.
+func Parse(b []byte) (*Envelope, error) {
+	var env Envelope
+	if err := json.Unmarshal(b, &env); err != nil || env.Version == 0 {
+		return nil, ErrNotEnvelope
+	}
+	if err := env.Normalize(); err != nil {
+		return nil, err
+	}
+	return &env, nil
+}
+
+// Normalize validates the version and fills in the fields a sender may leave out.
+func (e *Envelope) Normalize() error {
+	if e.Version == 0 {
+		e.Version = Version
+	}
+	if e.Version > Version {
+		return ErrUnsupportedVersion
+	}
+	if e.Id == "" {
+		e.Id = uuid.NewString()
+	}
+	if e.Type == "" {
+		e.Type = TypeMessage
+	}
+	if e.Ts == 0 {
+		e.Ts = time.Now().UnixMilli()
+	}
+	if e.IsBinary() {
+		if _, err := e.Data(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Encode renders the envelope for the wire. In raw format plain messages are
+// written as their bare payload, a JSON string payload being unquoted first
+// and a binary payload decoded; every other type, and messages to be acked,
+// need the envelope and are always written whole.
+func (e *Envelope) Encode(format string) ([]byte, error) {
+	if !e.bare(format) {
+		return json.Marshal(e)
+	}
+	if e.IsBinary() {
+		return e.Data()
+	}
+	var text string
+	if err := json.Unmarshal(e.Payload, &text); err == nil {
+		return []byte(text), nil
+	}
+	return e.Payload, nil
+}
+
+// EncodesBinary reports whether Encode renders the envelope as binary data
+// rather than text.
+func (e *Envelope) EncodesBinary(format string) bool {
+	return e.bare(format) && e.IsBinary()
+}
+
+func (e *Envelope) bare(format string) bool {
+	return format == FormatRaw && e.Type == TypeMessage && !e.Ack
+}
@@ -0,0 +1,22 @@
+package metrics
+
+// Directions of Messages.
+const (
+	In  = "in"
+	Out = "out"
+)
+
+var (
+	UpgradeFailures = NewCounter("rrm_upgrade_failures_total",
+		"Client connections that failed to open, by transport and reason.", "transport", "reason")
+	Messages = NewCounter("rrm_messages_total",
+		"Messages received from clients and sent by services, by direction, endpoint and result.", "direction", "endpoint", "result")
+	SendDuration = NewHistogram("rrm_send_duration_seconds",
+		"Time taken to serve service send requests, by endpoint.", DefBuckets, "endpoint")
+	RedisDuration = NewHistogram("rrm_redis_operation_duration_seconds",
+		"Latency of session store operations, by operation.", DefBuckets, "operation")
+	RedisErrors = NewCounter("rrm_redis_operation_errors_total",
+		"Failed session store operations, by operation.", "operation")
+	SessionEvents = NewCounter("rrm_session_events_total",
+		"Session lifecycle events published by this instance, by event.", "event")
+)
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jibitesh/request-response-manager/internal/cluster"
+	"github.com/jibitesh/request-response-manager/internal/config"
+	"github.com/jibitesh/request-response-manager/internal/ws"
+	"github.com/jibitesh/request-response-manager/pkg/instance"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	componentUp   = "up"
+	componentDown = "down"
+)
+
+type component struct {
+	Status    string  `json:"status"`
+	Error     string  `json:"error,omitempty"`
+	LatencyMs float64 `json:"latencyMs,omitempty"`
+	// Ready is whether the instance's readiness depends on the component.
+	Ready bool `json:"ready"`
+}
+
+type statusReport struct {
+	Instance               string               `json:"instance"`
+	Version                string               `json:"version"`
+	Ready                  bool                 `json:"ready"`
+	Draining               bool                 `json:"draining"`
+	StartedAt              time.Time            `json:"startedAt"`
+	UptimeSeconds          int64                `json:"uptimeSeconds"`
+	Connections            int                  `json:"connections"`
+	MaxConnections         int                  `json:"maxConnections,omitempty"`
+	ConnectionsByTransport map[string]float64   `json:"connectionsByTransport"`
+	Components             map[string]component `json:"components"`
+}
+
+// health answers the liveness, readiness and status probes. The instance is
+// ready while Redis answers, it is not draining and it can take connections.
+type health struct {
+	cfg       *config.Config
+	instance  *instance.Instance
+	redis     *redis.Client
+	wsManager *ws.ConnectionManager
+	heartbeat *cluster.Heartbeat
+}
+
+func (h *health) check(ctx context.Context) (map[string]component, bool) {
+	components := make(map[string]component)
+
+	ctx, cancel := context.WithTimeout(ctx, h.cfg.Health.PingTimeout)
+	defer cancel()
+	start := time.Now()
+	redisUp := component{Status: componentUp, Ready: true}
+	if err := h.redis.Ping(ctx).Err(); err != nil {
+		redisUp = component{Status: componentDown, Error: err.Error(), Ready: true}
+	}
+	redisUp.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	components["redis"] = redisUp
+
+	components["connections"] = component{Status: componentUp, Ready: true}
+	if h.wsManager.AtCapacity() {
+		components["connections"] = component{Status: componentDown, Error: fmt.Sprintf("limit of %d connections reached", h.cfg.Connection.MaxConnections), Ready: true}
+	}
+	components["drain"] = component{Status: componentUp, Ready: true}
+	if h.wsManager.Draining() {
+		components["drain"] = component{Status: componentDown, Error: "instance is draining", Ready: true}
+	}
+
+	components["heartbeat"] = component{Status: componentUp}
+	if last, err := h.heartbeat.Status(); err != nil {
+		components["heartbeat"] = component{Status: componentDown, Error: err.Error()}
+	} else if last.IsZero() {
+		components["heartbeat"] = component{Status: componentDown, Error: "not registered yet"}
+	}
+
+	ready := true
+	for _, c := range components {
+		if c.Ready && c.Status != componentUp {
+			ready = false
+		}
+	}
+	return components, ready
+}
+
+// Handles GET /healthz. The instance is live while it serves HTTP.
+func (h *health) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// Handles GET /readyz, failing with the components that keep the instance
+// from taking new connections.
+func (h *health) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	components, ready := h.check(r.Context())
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if ready {
+		_, _ = w.Write([]byte("ok\n"))
+		return
+	}
+	var failed []string
+	for name, c := range components {
+		if c.Ready && c.Status != componentUp {
+			failed = append(failed, fmt.Sprintf("%s: %s", name, c.Error))
+		}
+	}
+	sort.Strings(failed)
+	w.WriteHeader(http.StatusServiceUnavailable)
+	_, _ = w.Write([]byte("not ready\n" + strings.Join(failed, "\n") + "\n"))
+}
+
+// Handles GET /status with the instance's component health, uptime, version
+// and connections. Like /readyz it answers 503 when the instance is not ready.
+func (h *health) handleStatus(w http.ResponseWriter, r *http.Request) {
+	components, ready := h.check(r.Context())
+	startedAt := h.heartbeat.StartedAt()
+	report := statusReport{
+		Instance:               h.instance.Name,
+		Version:                instance.Version,
+		Ready:                  ready,
+		Draining:               h.wsManager.Draining(),
+		StartedAt:              startedAt,
+		UptimeSeconds:          int64(time.Since(startedAt).Seconds()),
+		Connections:            h.wsManager.ConnectionCount(),
+		MaxConnections:         h.cfg.Connection.MaxConnections,
+		ConnectionsByTransport: h.wsManager.ConnectionsByTransport(),
+		Components:             components,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(report)
+}
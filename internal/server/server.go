@@ -6,9 +6,14 @@ import (
 	"strconv"
 	"sync"
 
+	"github.com/jibitesh/request-response-manager/internal/auth"
+	"github.com/jibitesh/request-response-manager/internal/cluster"
 	"github.com/jibitesh/request-response-manager/internal/config"
 	"github.com/jibitesh/request-response-manager/internal/logger"
+	"github.com/jibitesh/request-response-manager/internal/message"
+	"github.com/jibitesh/request-response-manager/internal/metrics"
 	"github.com/jibitesh/request-response-manager/internal/store"
+	"github.com/jibitesh/request-response-manager/internal/upstream"
 	"github.com/jibitesh/request-response-manager/internal/ws"
 	"github.com/jibitesh/request-response-manager/pkg/instance"
 )
@@ -18,26 +23,103 @@ type Server struct {
 	httpSrv        *http.Server
 	sessionService *store.SessionService
 	wsManager      *ws.ConnectionManager
+	heartbeat      *cluster.Heartbeat
+	reaper         *cluster.Reaper
 	mu             sync.Mutex
 }
 
 func NewServer(cfg *config.Config, instance *instance.Instance) (*Server, error) {
-	sessionStore, err := store.NewRedisStore(cfg, instance)
+	redisClient, err := store.NewRedisClient(cfg)
 	if err != nil {
 		panic(err)
 	}
-	sessionService := store.NewSessionService(instance, sessionStore)
-	wsManager := ws.NewConnectionManager(sessionService)
+	sessionStore := store.NewMeasuredStore(store.NewRedisStore(cfg, redisClient, instance))
+	sessionService := store.NewSessionService(instance, sessionStore, store.NewRedisEventPublisher(redisClient), store.NewRedisReplayBuffer(redisClient), store.NewRedisTopicStore(cfg, redisClient), store.NewRedisUserIndex(cfg, redisClient), store.NewRedisAckStore(redisClient), store.NewRedisMailbox(cfg, redisClient))
+	var verifier *auth.Verifier
+	if cfg.Auth.JWT.Enabled {
+		if verifier, err = auth.NewVerifier(cfg); err != nil {
+			return nil, err
+		}
+	}
+	services, err := auth.NewServiceAuthenticator(cfg, store.NewRedisNonceStore(redisClient))
+	if err != nil {
+		return nil, err
+	}
+	wsManager := ws.NewConnectionManager(cfg, sessionService, cluster.NewClient(cfg), upstream.NewDispatcher(cfg, instance), verifier)
+	registry := store.NewRedisInstanceRegistry(redisClient)
+	metrics.NewGaugeFunc("rrm_connections_active", "Client connections held by this instance, by transport.", "transport", wsManager.ConnectionsByTransport)
+	heartbeat := cluster.NewHeartbeat(cfg, registry, instance, wsManager.ConnectionCount, wsManager.CloseReaped)
+	reaper := cluster.NewReaper(cfg, registry, sessionService)
+	health := &health{cfg: cfg, instance: instance, redis: redisClient, wsManager: wsManager, heartbeat: heartbeat}
 
 	mux := http.NewServeMux()
 	logger.Info("setting /ws as client websocket handler")
 	mux.HandleFunc("/ws", wsManager.HandleWSClient)
+	logger.Info("setting /sse as client server-sent events handler")
+	mux.HandleFunc("/sse", wsManager.HandleSSE)
+	logger.Info("setting /poll and /poll/{id} as client long-polling handlers")
+	mux.HandleFunc("/poll", wsManager.HandlePollOpen)
+	mux.HandleFunc("/poll/", byMethod(map[string]http.HandlerFunc{
+		http.MethodGet:  wsManager.HandlePoll,
+		http.MethodPost: wsManager.HandlePollSend,
+	}))
 	logger.Info("setting /ws/send/{id} as micro-service session send handler")
-	mux.HandleFunc("/ws/send/", wsManager.HandleWSSend)
+	mux.HandleFunc("/ws/send/", services.Require(auth.ScopeSend, wsManager.HandleWSSend))
 	logger.Info("setting /session/{id} as session lookup handler")
-	mux.HandleFunc("/session/", ws.SessionLookupHandler(sessionService))
+	mux.HandleFunc("/session/", services.Require(auth.ScopeLookup, ws.SessionLookupHandler(sessionService)))
+	logger.Info("setting /instances as live instance listing handler")
+	mux.HandleFunc("/instances", services.Require(auth.ScopeAdmin, cluster.InstancesHandler(registry)))
+	logger.Info("setting /admin/sessions and /admin/sessions/{id} as session admin handlers")
+	mux.HandleFunc("/admin/sessions", services.Require(auth.ScopeAdmin, byMethod(map[string]http.HandlerFunc{
+		http.MethodGet: wsManager.HandleAdminSessions(registry),
+	})))
+	mux.HandleFunc("/admin/sessions/", services.Require(auth.ScopeAdmin, byMethod(map[string]http.HandlerFunc{
+		http.MethodGet:    wsManager.HandleAdminSession,
+		http.MethodDelete: wsManager.HandleAdminDisconnect,
+	})))
 	logger.Info("setting /send as REST session send handler")
-	mux.HandleFunc("/send", wsManager.HandleSend)
+	mux.HandleFunc("/send", services.Require(auth.ScopeSend, metrics.Timed("send", wsManager.HandleSend)))
+	logger.Info("setting /send/batch as REST batch send handler")
+	mux.HandleFunc("/send/batch", services.Require(auth.ScopeSend, metrics.Timed("send_batch", wsManager.HandleSendBatch)))
+	logger.Info("setting /send/user as REST user send handler")
+	mux.HandleFunc("/send/user", services.Require(auth.ScopeSend, metrics.Timed("send_user", wsManager.HandleSendUser)))
+	logger.Info("setting /subscribe and /unsubscribe as topic subscription handlers")
+	mux.HandleFunc("/subscribe", services.Require(auth.ScopeSend, wsManager.HandleSubscription(message.TypeSubscribe)))
+	mux.HandleFunc("/unsubscribe", services.Require(auth.ScopeSend, wsManager.HandleSubscription(message.TypeUnsubscribe)))
+	logger.Info("setting /publish as topic publish handler")
+	mux.HandleFunc("/publish", services.Require(auth.ScopeSend, metrics.Timed("publish", wsManager.HandlePublish)))
+	logger.Info("setting /mailbox/{kind}/{id} as offline mailbox inspect and purge handler")
+	mux.HandleFunc("/mailbox/", byMethod(map[string]http.HandlerFunc{
+		http.MethodGet:    services.Require(auth.ScopeLookup, wsManager.HandleMailboxList),
+		http.MethodDelete: services.Require(auth.ScopeAdmin, wsManager.HandleMailboxPurge),
+	}))
+	logger.Info("setting /broadcast as cluster-wide broadcast handler")
+	mux.HandleFunc("/broadcast", services.Require(auth.ScopeAdmin, metrics.Timed("broadcast", wsManager.HandleBroadcast(registry))))
+	logger.Info("setting /request as REST session request/response handler")
+	mux.HandleFunc("/request", services.Require(auth.ScopeSend, metrics.Timed("request", wsManager.HandleRequest)))
+	logger.Info("setting /healthz, /readyz and /status as health handlers")
+	mux.HandleFunc("/healthz", health.handleHealthz)
+	mux.HandleFunc("/readyz", health.handleReadyz)
+	mux.HandleFunc("/status", health.handleStatus)
+	logger.Info("setting /metrics as Prometheus metrics handler")
+	mux.HandleFunc("/metrics", metrics.Handler)
+	logger.Info("setting /internal/deliver as peer instance delivery handler")
+	mux.HandleFunc("/internal/deliver", services.Require(auth.ScopePeer, wsManager.HandleInternalDeliver))
+	logger.Info("setting /internal/deliver/batch as peer instance batch delivery handler")
+	mux.HandleFunc("/internal/deliver/batch", services.Require(auth.ScopePeer, wsManager.HandleInternalDeliverBatch))
+	logger.Info("setting /internal/ack as peer instance client ack handler")
+	mux.HandleFunc("/internal/ack", services.Require(auth.ScopePeer, wsManager.HandleInternalAck))
+	logger.Info("setting /internal/broadcast as peer instance broadcast handler")
+	mux.HandleFunc("/internal/broadcast", services.Require(auth.ScopePeer, wsManager.HandleInternalBroadcast))
+	logger.Info("setting /internal/poll and /internal/poll/send as peer instance long-polling handlers")
+	mux.HandleFunc("/internal/poll", services.Require(auth.ScopePeer, wsManager.HandleInternalPoll))
+	mux.HandleFunc("/internal/poll/send", services.Require(auth.ScopePeer, wsManager.HandleInternalPollSend))
+	logger.Info("setting /internal/admin/* as peer instance session admin handlers")
+	mux.HandleFunc("/internal/admin/sessions", services.Require(auth.ScopePeer, wsManager.HandleInternalAdminSessions))
+	mux.HandleFunc("/internal/admin/session", services.Require(auth.ScopePeer, wsManager.HandleInternalAdminSession))
+	mux.HandleFunc("/internal/admin/disconnect", services.Require(auth.ScopePeer, wsManager.HandleInternalAdminDisconnect))
+	logger.Info("setting /internal/request as peer instance request handler")
+	mux.HandleFunc("/internal/request", services.Require(auth.ScopePeer, wsManager.HandleInternalRequest))
 
 	httpSrv := &http.Server{
 		Addr:    ":" + strconv.Itoa(cfg.Server.Port),
@@ -49,20 +131,58 @@ func NewServer(cfg *config.Config, instance *instance.Instance) (*Server, error)
 		httpSrv:        httpSrv,
 		sessionService: sessionService,
 		wsManager:      wsManager,
+		heartbeat:      heartbeat,
+		reaper:         reaper,
 	}, nil
 }
 
 func (s *Server) Start() error {
+	// A previous process with the same instance id may have left sessions behind.
+	if n, err := s.sessionService.ReapInstance(context.Background(), s.sessionService.Instance().Name); err != nil {
+		logger.Errorf("failed to reap sessions of previous instance: %v", err)
+	} else if n > 0 {
+		logger.Infof("reaped %d sessions left by previous instance", n)
+	}
+	if err := s.heartbeat.Start(); err != nil {
+		logger.Errorf("initial instance heartbeat failed: %v", err)
+	}
+	s.reaper.Start()
+	s.wsManager.Start()
 	logger.Infof("starting server on port %d", s.cfg.Server.Port)
 	return s.httpSrv.ListenAndServe()
 }
 
+// Shutdown drains client connections while the instance still serves peers,
+// then stops the background work, deregisters the instance and releases the
+// sessions of any clients that did not leave. The sessions are released and
+// the instance's session index dropped even when the HTTP server fails to
+// shut down in time, whose error is returned last.
 func (s *Server) Shutdown(ctx context.Context) error {
-	if err := s.httpSrv.Shutdown(ctx); err != nil {
-		return err
+	s.wsManager.Drain(ctx)
+	s.reaper.Stop()
+	if err := s.heartbeat.Stop(ctx); err != nil {
+		logger.Infof("warning: instance deregister error: %v", err)
 	}
+	// Closing what outlasted the drain lets long-lived SSE and poll handlers
+	// return, so the HTTP server can go idle.
 	if err := s.wsManager.CloseAllConnections(); err != nil {
 		logger.Infof("warning: ws manager close error: %v", err)
 	}
-	return nil
+	err := s.httpSrv.Shutdown(ctx)
+	if err := s.sessionService.DropInstance(context.Background()); err != nil {
+		logger.Infof("warning: session index drop error: %v", err)
+	}
+	return err
+}
+
+// byMethod routes a request to the handler registered for its method.
+func byMethod(handlers map[string]http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h, ok := handlers[r.Method]
+		if !ok {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h(w, r)
+	}
 }
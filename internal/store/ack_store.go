@@ -0,0 +1,58 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jibitesh/request-response-manager/pkg/instance"
+	"github.com/redis/go-redis/v9"
+)
+
+// AckStore records which instance tracks an unacknowledged message, so an ack
+// reaching another instance after the session moved can be routed back to it.
+type AckStore interface {
+	Track(ctx context.Context, messageId string, owner *instance.Instance, ttl time.Duration) error
+	Owner(ctx context.Context, messageId string) (*instance.Instance, error)
+	Remove(ctx context.Context, messageId string) error
+}
+
+type RedisAckStore struct {
+	client *redis.Client
+}
+
+func NewRedisAckStore(client *redis.Client) *RedisAckStore {
+	return &RedisAckStore{client: client}
+}
+
+func (a RedisAckStore) redisKey(messageId string) string {
+	return fmt.Sprintf("ack:%s", messageId)
+}
+
+func (a RedisAckStore) Track(ctx context.Context, messageId string, owner *instance.Instance, ttl time.Duration) error {
+	b, err := json.Marshal(owner)
+	if err != nil {
+		return err
+	}
+	return a.client.Set(ctx, a.redisKey(messageId), b, ttl).Err()
+}
+
+func (a RedisAckStore) Owner(ctx context.Context, messageId string) (*instance.Instance, error) {
+	raw, err := a.client.Get(ctx, a.redisKey(messageId)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var owner instance.Instance
+	if err := json.Unmarshal(raw, &owner); err != nil {
+		return nil, err
+	}
+	return &owner, nil
+}
+
+func (a RedisAckStore) Remove(ctx context.Context, messageId string) error {
+	return a.client.Del(ctx, a.redisKey(messageId)).Err()
+}
@@ -0,0 +1,47 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const sessionEventsChannel = "session-events"
+
+const (
+	EventSessionCreated  = "session.created"
+	EventSessionRemoved  = "session.removed"
+	EventSessionReaped   = "session.reaped"
+	EventSessionDetached = "session.detached"
+	EventSessionResumed  = "session.resumed"
+)
+
+type SessionEvent struct {
+	Type      string    `json:"type"`
+	SessionId string    `json:"session_id"`
+	Instance  string    `json:"instance"`
+	Ts        time.Time `json:"ts"`
+}
+
+type EventPublisher interface {
+	Publish(ctx context.Context, ev *SessionEvent) error
+}
+
+// RedisEventPublisher publishes session lifecycle events on the session-events channel.
+type RedisEventPublisher struct {
+	client *redis.Client
+}
+
+func NewRedisEventPublisher(client *redis.Client) *RedisEventPublisher {
+	return &RedisEventPublisher{client: client}
+}
+
+func (p RedisEventPublisher) Publish(ctx context.Context, ev *SessionEvent) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	return p.client.Publish(ctx, sessionEventsChannel, b).Err()
+}
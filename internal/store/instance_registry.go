@@ -0,0 +1,132 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jibitesh/request-response-manager/pkg/instance"
+	"github.com/redis/go-redis/v9"
+)
+
+const instancesKey = "instances"
+
+type InstanceInfo struct {
+	instance.Instance
+	Version     string    `json:"version"`
+	StartedAt   time.Time `json:"started_at"`
+	Connections int       `json:"connections"`
+	HeartbeatAt time.Time `json:"heartbeat_at"`
+}
+
+type InstanceRegistry interface {
+	Register(ctx context.Context, info *InstanceInfo, ttl time.Duration) (bool, error)
+	Deregister(ctx context.Context, name string) error
+	List(ctx context.Context) ([]*InstanceInfo, error)
+	ClaimDead(ctx context.Context) ([]string, error)
+}
+
+type RedisInstanceRegistry struct {
+	client *redis.Client
+}
+
+func NewRedisInstanceRegistry(client *redis.Client) *RedisInstanceRegistry {
+	return &RedisInstanceRegistry{client: client}
+}
+
+func (r RedisInstanceRegistry) redisKey(name string) string {
+	return fmt.Sprintf("instance:%s", name)
+}
+
+// Register writes the heartbeat record with ttl; an instance that stops
+// heartbeating drops out of List once the record expires. It reports whether
+// the instance was not a member yet, which after the first registration
+// means a reaper claimed it as dead.
+func (r RedisInstanceRegistry) Register(ctx context.Context, info *InstanceInfo, ttl time.Duration) (bool, error) {
+	b, err := json.Marshal(info)
+	if err != nil {
+		return false, err
+	}
+	var added *redis.IntCmd
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, r.redisKey(info.Name), b, ttl)
+		added = pipe.SAdd(ctx, instancesKey, info.Name)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return added.Val() > 0, nil
+}
+
+func (r RedisInstanceRegistry) Deregister(ctx context.Context, name string) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, r.redisKey(name))
+		pipe.SRem(ctx, instancesKey, name)
+		return nil
+	})
+	return err
+}
+
+// List returns the live instances. Members whose heartbeat expired are skipped
+// and left for ClaimDead.
+func (r RedisInstanceRegistry) List(ctx context.Context) ([]*InstanceInfo, error) {
+	names, err := r.client.SMembers(ctx, instancesKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, len(names))
+	for i, name := range names {
+		keys[i] = r.redisKey(name)
+	}
+	raws, err := r.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]*InstanceInfo, 0, len(raws))
+	for i, raw := range raws {
+		s, ok := raw.(string)
+		if !ok {
+			continue
+		}
+		var info InstanceInfo
+		if err := json.Unmarshal([]byte(s), &info); err != nil {
+			return nil, fmt.Errorf("instance %s: %w", names[i], err)
+		}
+		infos = append(infos, &info)
+	}
+	return infos, nil
+}
+
+// ClaimDead returns the members whose heartbeat expired and removes them from
+// the member set. Only one caller can remove a member, so each dead instance
+// is claimed by exactly one reaper across the cluster.
+func (r RedisInstanceRegistry) ClaimDead(ctx context.Context) ([]string, error) {
+	names, err := r.client.SMembers(ctx, instancesKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	var dead []string
+	for _, name := range names {
+		alive, err := r.client.Exists(ctx, r.redisKey(name)).Result()
+		if err != nil {
+			return dead, err
+		}
+		if alive > 0 {
+			continue
+		}
+		removed, err := r.client.SRem(ctx, instancesKey, name).Result()
+		if err != nil {
+			return dead, err
+		}
+		if removed > 0 {
+			dead = append(dead, name)
+		}
+	}
+	return dead, nil
+}
@@ -0,0 +1,201 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jibitesh/request-response-manager/internal/config"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	MailboxSession = "session"
+	MailboxUser    = "user"
+)
+
+type MailEntry struct {
+	Id        string    `json:"id"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Frame     []byte    `json:"-"`
+}
+
+// Mailbox keeps messages for sessions and users that are offline until a
+// client comes back. It also retains removed sessions for as long as mail may
+// be kept for them so their client can reclaim the session id.
+type Mailbox interface {
+	Enabled() bool
+	Push(ctx context.Context, kind, id string, frame []byte, ttl time.Duration) (string, error)
+	Drain(ctx context.Context, kind, id string) ([]MailEntry, error)
+	List(ctx context.Context, kind, id string, count int64) ([]MailEntry, int64, error)
+	Purge(ctx context.Context, kind, id string, entryIds ...string) (int64, error)
+	Retain(ctx context.Context, si *SessionInfo) error
+	Reclaim(ctx context.Context, sessionId string, valid func(*SessionInfo) bool) (*SessionInfo, error)
+	Forget(ctx context.Context, sessionId string) error
+}
+
+type RedisMailbox struct {
+	client  *redis.Client
+	enabled bool
+	maxSize int64
+	maxTTL  time.Duration
+}
+
+func NewRedisMailbox(cfg *config.Config, client *redis.Client) *RedisMailbox {
+	return &RedisMailbox{
+		client:  client,
+		enabled: cfg.Mailbox.Enabled,
+		maxSize: int64(cfg.Mailbox.MaxSize),
+		maxTTL:  cfg.Mailbox.MaxTTL,
+	}
+}
+
+func (m RedisMailbox) redisKey(kind, id string) string {
+	return fmt.Sprintf("mailbox:%s:%s", kind, id)
+}
+
+func (m RedisMailbox) retainedKey(sessionId string) string {
+	return fmt.Sprintf("mailbox:session:%s:retained", sessionId)
+}
+
+func (m RedisMailbox) Enabled() bool {
+	return m.enabled
+}
+
+// Push appends frame to the mailbox, trimming the oldest entries beyond the
+// maximum size. The mailbox itself lives as long as its longest-lived entry.
+func (m RedisMailbox) Push(ctx context.Context, kind, id string, frame []byte, ttl time.Duration) (string, error) {
+	key := m.redisKey(kind, id)
+	expiresAt := time.Now().Add(ttl).UnixMilli()
+	entryId, err := m.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: key,
+		MaxLen: m.maxSize,
+		Values: map[string]interface{}{"frame": frame, "expires_at": expiresAt},
+	}).Result()
+	if err != nil {
+		return "", err
+	}
+	if cur, err := m.client.PTTL(ctx, key).Result(); err == nil && cur < ttl {
+		_ = m.client.PExpire(ctx, key, ttl).Err()
+	}
+	return entryId, nil
+}
+
+// Drain empties the mailbox and returns its unexpired entries in order.
+func (m RedisMailbox) Drain(ctx context.Context, kind, id string) ([]MailEntry, error) {
+	key := m.redisKey(kind, id)
+	var xrange *redis.XMessageSliceCmd
+	_, err := m.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		xrange = pipe.XRange(ctx, key, "-", "+")
+		pipe.Del(ctx, key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return unexpired(xrange.Val(), time.Now()), nil
+}
+
+// List returns up to count of the oldest unexpired entries and the number of
+// entries in the mailbox, expired ones included.
+func (m RedisMailbox) List(ctx context.Context, kind, id string, count int64) ([]MailEntry, int64, error) {
+	key := m.redisKey(kind, id)
+	var xlen *redis.IntCmd
+	var xrange *redis.XMessageSliceCmd
+	_, err := m.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		xlen = pipe.XLen(ctx, key)
+		xrange = pipe.XRangeN(ctx, key, "-", "+", count)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return unexpired(xrange.Val(), time.Now()), xlen.Val(), nil
+}
+
+// Purge deletes the given entries, or the whole mailbox when none are given,
+// and returns how many entries were deleted.
+func (m RedisMailbox) Purge(ctx context.Context, kind, id string, entryIds ...string) (int64, error) {
+	key := m.redisKey(kind, id)
+	if len(entryIds) > 0 {
+		return m.client.XDel(ctx, key, entryIds...).Result()
+	}
+	var xlen *redis.IntCmd
+	_, err := m.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		xlen = pipe.XLen(ctx, key)
+		pipe.Del(ctx, key)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return xlen.Val(), nil
+}
+
+// Retain remembers a removed session for the longest time mail may be kept.
+func (m RedisMailbox) Retain(ctx context.Context, si *SessionInfo) error {
+	if !m.enabled || si.ResumeToken == "" {
+		return nil
+	}
+	b, err := json.Marshal(si)
+	if err != nil {
+		return err
+	}
+	return m.client.Set(ctx, m.retainedKey(si.SessionId), b, m.maxTTL).Err()
+}
+
+// Reclaim returns and forgets a retained session that valid accepts, so
+// only one client can reclaim it and a client that fails the check leaves it
+// in place. A session that is not retained, or that valid rejects, is
+// ErrNotFound.
+func (m RedisMailbox) Reclaim(ctx context.Context, sessionId string, valid func(*SessionInfo) bool) (*SessionInfo, error) {
+	key := m.retainedKey(sessionId)
+	var si SessionInfo
+	err := m.client.Watch(ctx, func(tx *redis.Tx) error {
+		raw, err := tx.Get(ctx, key).Bytes()
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(raw, &si); err != nil {
+			return err
+		}
+		if !valid(&si) {
+			return ErrNotFound
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key)
+			return nil
+		})
+		return err
+	}, key)
+	// A concurrent reclaim that won the race took the session.
+	if errors.Is(err, redis.Nil) || errors.Is(err, redis.TxFailedErr) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &si, nil
+}
+
+// Forget drops a retained session so it can no longer be reclaimed.
+func (m RedisMailbox) Forget(ctx context.Context, sessionId string) error {
+	return m.client.Del(ctx, m.retainedKey(sessionId)).Err()
+}
+
+func unexpired(msgs []redis.XMessage, now time.Time) []MailEntry {
+	entries := make([]MailEntry, 0, len(msgs))
+	for _, msg := range msgs {
+		frame, _ := msg.Values["frame"].(string)
+		ms, _ := msg.Values["expires_at"].(string)
+		n, _ := strconv.ParseInt(ms, 10, 64)
+		expiresAt := time.UnixMilli(n)
+		if now.After(expiresAt) {
+			continue
+		}
+		entries = append(entries, MailEntry{Id: msg.ID, ExpiresAt: expiresAt, Frame: []byte(frame)})
+	}
+	return entries
+}
@@ -0,0 +1,106 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jibitesh/request-response-manager/internal/metrics"
+)
+
+// MeasuredSessionStore records the latency and errors of every operation of
+// the SessionStore it wraps. A missing session is not an error.
+type MeasuredSessionStore struct {
+	store SessionStore
+}
+
+func NewMeasuredStore(store SessionStore) *MeasuredSessionStore {
+	return &MeasuredSessionStore{store: store}
+}
+
+func observe(op string, start time.Time, err error) {
+	metrics.RedisDuration.Since(start, op)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		metrics.RedisErrors.Inc(op)
+	}
+}
+
+func (m MeasuredSessionStore) Get(ctx context.Context, sessionId string) (*SessionInfo, error) {
+	start := time.Now()
+	si, err := m.store.Get(ctx, sessionId)
+	observe("get", start, err)
+	return si, err
+}
+
+func (m MeasuredSessionStore) GetMany(ctx context.Context, sessionIds []string) (map[string]*SessionInfo, error) {
+	start := time.Now()
+	infos, err := m.store.GetMany(ctx, sessionIds)
+	observe("get_many", start, err)
+	return infos, err
+}
+
+func (m MeasuredSessionStore) Set(ctx context.Context, sessionId string, si *SessionInfo) error {
+	start := time.Now()
+	err := m.store.Set(ctx, sessionId, si)
+	observe("set", start, err)
+	return err
+}
+
+func (m MeasuredSessionStore) SetWithTTL(ctx context.Context, sessionId string, si *SessionInfo, ttl time.Duration) error {
+	start := time.Now()
+	err := m.store.SetWithTTL(ctx, sessionId, si, ttl)
+	observe("set_with_ttl", start, err)
+	return err
+}
+
+func (m MeasuredSessionStore) Update(ctx context.Context, sessionId string, fn func(si *SessionInfo) (time.Duration, error)) (*SessionInfo, error) {
+	start := time.Now()
+	// Errors of fn leave the session alone on purpose and are not failures.
+	var fnErr error
+	si, err := m.store.Update(ctx, sessionId, func(si *SessionInfo) (time.Duration, error) {
+		var ttl time.Duration
+		ttl, fnErr = fn(si)
+		return ttl, fnErr
+	})
+	if fnErr != nil && errors.Is(err, fnErr) {
+		observe("update", start, nil)
+	} else {
+		observe("update", start, err)
+	}
+	return si, err
+}
+
+func (m MeasuredSessionStore) Refresh(ctx context.Context, sessionId string) error {
+	start := time.Now()
+	err := m.store.Refresh(ctx, sessionId)
+	observe("refresh", start, err)
+	return err
+}
+
+func (m MeasuredSessionStore) RefreshMany(ctx context.Context, sessionIds []string) error {
+	start := time.Now()
+	err := m.store.RefreshMany(ctx, sessionIds)
+	observe("refresh_many", start, err)
+	return err
+}
+
+func (m MeasuredSessionStore) Delete(ctx context.Context, sessionId string) error {
+	start := time.Now()
+	err := m.store.Delete(ctx, sessionId)
+	observe("delete", start, err)
+	return err
+}
+
+func (m MeasuredSessionStore) DeleteByInstance(ctx context.Context, instanceName string) ([]*SessionInfo, error) {
+	start := time.Now()
+	infos, err := m.store.DeleteByInstance(ctx, instanceName)
+	observe("delete_by_instance", start, err)
+	return infos, err
+}
+
+func (m MeasuredSessionStore) DropInstance(ctx context.Context, instanceName string) error {
+	start := time.Now()
+	err := m.store.DropInstance(ctx, instanceName)
+	observe("drop_instance", start, err)
+	return err
+}
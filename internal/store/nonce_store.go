@@ -0,0 +1,31 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// NonceStore remembers request nonces so signed requests cannot be replayed.
+type NonceStore interface {
+	// Claim records nonce for ttl and reports whether it was unused.
+	Claim(ctx context.Context, credentialId, nonce string, ttl time.Duration) (bool, error)
+}
+
+type RedisNonceStore struct {
+	client *redis.Client
+}
+
+func NewRedisNonceStore(client *redis.Client) *RedisNonceStore {
+	return &RedisNonceStore{client: client}
+}
+
+func (n RedisNonceStore) redisKey(credentialId, nonce string) string {
+	return fmt.Sprintf("nonce:%s:%s", credentialId, nonce)
+}
+
+func (n RedisNonceStore) Claim(ctx context.Context, credentialId, nonce string, ttl time.Duration) (bool, error) {
+	return n.client.SetNX(ctx, n.redisKey(credentialId, nonce), 1, ttl).Result()
+}
@@ -15,9 +15,15 @@ import (
 
 type SessionStore interface {
 	Get(context context.Context, sessionId string) (*SessionInfo, error)
+	GetMany(context context.Context, sessionIds []string) (map[string]*SessionInfo, error)
 	Set(context context.Context, sessionId string, si *SessionInfo) error
+	SetWithTTL(context context.Context, sessionId string, si *SessionInfo, ttl time.Duration) error
+	Update(context context.Context, sessionId string, fn func(si *SessionInfo) (time.Duration, error)) (*SessionInfo, error)
 	Refresh(context context.Context, sessionId string) error
+	RefreshMany(context context.Context, sessionIds []string) error
 	Delete(context context.Context, sessionId string) error
+	DeleteByInstance(context context.Context, instanceName string) ([]*SessionInfo, error)
+	DropInstance(context context.Context, instanceName string) error
 }
 
 type RedisSessionStore struct {
@@ -28,33 +34,109 @@ type RedisSessionStore struct {
 
 var ErrNotFound = errors.New("session not found")
 
-func NewRedisStore(cfg *config.Config, instance *instance.Instance) (*RedisSessionStore, error) {
+// maxUpdateAttempts bounds how often Update retries when other writers keep
+// changing the session under it.
+const maxUpdateAttempts = 5
+
+func NewRedisClient(cfg *config.Config) (*redis.Client, error) {
 	rdb := redis.NewClient(&redis.Options{
 		Addr: fmt.Sprintf("%s:%d", cfg.Redis.Host, cfg.Redis.Port),
 	})
 	if err := rdb.Ping(context.Background()).Err(); err != nil {
 		return nil, errors.New("redis: cannot connect to redis")
 	}
+	return rdb, nil
+}
+
+func NewRedisStore(cfg *config.Config, client *redis.Client, instance *instance.Instance) *RedisSessionStore {
 	return &RedisSessionStore{
-		client:   rdb,
+		client:   client,
 		ttl:      cfg.Redis.Timeout,
 		instance: instance,
-	}, nil
+	}
 }
 
 func (r RedisSessionStore) redisKey(sessionId string) string {
 	return fmt.Sprintf("session:%s", sessionId)
 }
 
+func (r RedisSessionStore) instanceKey(instanceName string) string {
+	return fmt.Sprintf("instance:%s:sessions", instanceName)
+}
+
 func (r RedisSessionStore) Set(ctx context.Context, sessionId string, si *SessionInfo) error {
+	return r.SetWithTTL(ctx, sessionId, si, r.ttl*time.Minute)
+}
+
+func (r RedisSessionStore) SetWithTTL(ctx context.Context, sessionId string, si *SessionInfo, ttl time.Duration) error {
 	logger.Info("Setting session info %v for %s", si, sessionId)
 	b, err := json.Marshal(si)
 	if err != nil {
-		logger.Error("Error marshalling session info: %v", err)
+		logger.Errorf("Error marshalling session info: %v", err)
 		return err
 	}
-	duration := r.ttl * time.Minute
-	return r.client.Set(ctx, r.redisKey(sessionId), b, duration).Err()
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, r.redisKey(sessionId), b, ttl)
+		pipe.SAdd(ctx, r.instanceKey(si.Instance.Name), sessionId)
+		return nil
+	})
+	return err
+}
+
+// Update reads the session, lets fn change it and writes it back, unless the
+// session changed in between, in which case it starts over. fn returns the
+// TTL to store the session with, 0 for the default and a negative one to
+// delete it, or an error to leave the session as it is; that error is
+// returned. The session is moved to its new owner's session index.
+func (r RedisSessionStore) Update(ctx context.Context, sessionId string, fn func(si *SessionInfo) (time.Duration, error)) (*SessionInfo, error) {
+	key := r.redisKey(sessionId)
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		var si SessionInfo
+		err := r.client.Watch(ctx, func(tx *redis.Tx) error {
+			raw, err := tx.Get(ctx, key).Bytes()
+			if errors.Is(err, redis.Nil) {
+				return ErrNotFound
+			} else if err != nil {
+				return err
+			}
+			if err := json.Unmarshal(raw, &si); err != nil {
+				return err
+			}
+			owner := si.Instance
+			ttl, err := fn(&si)
+			if err != nil {
+				return err
+			}
+			b, err := json.Marshal(&si)
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				if owner != nil && (ttl < 0 || !owner.Equal(si.Instance)) {
+					pipe.SRem(ctx, r.instanceKey(owner.Name), sessionId)
+				}
+				if ttl < 0 {
+					pipe.Del(ctx, key)
+					return nil
+				}
+				if ttl == 0 {
+					ttl = r.ttl * time.Minute
+				}
+				pipe.Set(ctx, key, b, ttl)
+				pipe.SAdd(ctx, r.instanceKey(si.Instance.Name), sessionId)
+				return nil
+			})
+			return err
+		}, key)
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &si, nil
+	}
+	return nil, redis.TxFailedErr
 }
 
 func (r RedisSessionStore) Get(ctx context.Context, sessionId string) (*SessionInfo, error) {
@@ -73,11 +155,94 @@ func (r RedisSessionStore) Get(ctx context.Context, sessionId string) (*SessionI
 	return &si, nil
 }
 
+// GetMany looks up sessionIds in one round trip. Sessions that do not exist
+// are absent from the returned map.
+func (r RedisSessionStore) GetMany(ctx context.Context, sessionIds []string) (map[string]*SessionInfo, error) {
+	infos := make(map[string]*SessionInfo, len(sessionIds))
+	if len(sessionIds) == 0 {
+		return infos, nil
+	}
+	keys := make([]string, len(sessionIds))
+	for i, id := range sessionIds {
+		keys[i] = r.redisKey(id)
+	}
+	raws, err := r.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, raw := range raws {
+		s, ok := raw.(string)
+		if !ok {
+			continue
+		}
+		var si SessionInfo
+		if err := json.Unmarshal([]byte(s), &si); err != nil {
+			return nil, err
+		}
+		infos[sessionIds[i]] = &si
+	}
+	return infos, nil
+}
+
 func (r RedisSessionStore) Refresh(ctx context.Context, sessionId string) error {
 	duration := r.ttl * time.Minute
 	return r.client.Expire(ctx, r.redisKey(sessionId), duration).Err()
 }
 
+func (r RedisSessionStore) RefreshMany(ctx context.Context, sessionIds []string) error {
+	duration := r.ttl * time.Minute
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, id := range sessionIds {
+			pipe.Expire(ctx, r.redisKey(id), duration)
+		}
+		return nil
+	})
+	return err
+}
+
+// Delete deletes the session and drops it from its owner's session index.
 func (r RedisSessionStore) Delete(ctx context.Context, sessionId string) error {
-	return r.client.Del(ctx, r.redisKey(sessionId)).Err()
+	_, err := r.Update(ctx, sessionId, func(si *SessionInfo) (time.Duration, error) {
+		return -1, nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// DeleteByInstance deletes every session still owned by instanceName along
+// with its session index, and returns the deleted sessions. Each session is
+// deleted only if it is still owned by instanceName when deleted, so one that
+// is resumed on another instance meanwhile is left alone.
+func (r RedisSessionStore) DeleteByInstance(ctx context.Context, instanceName string) ([]*SessionInfo, error) {
+	ids, err := r.client.SMembers(ctx, r.instanceKey(instanceName)).Result()
+	if err != nil {
+		return nil, err
+	}
+	var owned []*SessionInfo
+	for _, id := range ids {
+		si, err := r.Update(ctx, id, func(si *SessionInfo) (time.Duration, error) {
+			if si.Instance == nil || si.Instance.Name != instanceName {
+				return 0, errNotOwned
+			}
+			return -1, nil
+		})
+		if errors.Is(err, ErrNotFound) || errors.Is(err, errNotOwned) {
+			continue
+		} else if err != nil {
+			return owned, err
+		}
+		owned = append(owned, si)
+	}
+	if err := r.DropInstance(ctx, instanceName); err != nil {
+		return owned, err
+	}
+	return owned, nil
+}
+
+// DropInstance deletes the session index of instanceName. The sessions it
+// still lists expire with their TTL.
+func (r RedisSessionStore) DropInstance(ctx context.Context, instanceName string) error {
+	return r.client.Del(ctx, r.instanceKey(instanceName)).Err()
 }
@@ -0,0 +1,66 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ReplayBuffer holds messages for detached sessions until they resume.
+type ReplayBuffer interface {
+	Push(ctx context.Context, sessionId string, max int, ttl time.Duration, frames ...[]byte) error
+	Drain(ctx context.Context, sessionId string) ([][]byte, error)
+}
+
+type RedisReplayBuffer struct {
+	client *redis.Client
+}
+
+func NewRedisReplayBuffer(client *redis.Client) *RedisReplayBuffer {
+	return &RedisReplayBuffer{client: client}
+}
+
+func (b RedisReplayBuffer) redisKey(sessionId string) string {
+	return fmt.Sprintf("replay:%s", sessionId)
+}
+
+// Push appends frames, keeping only the newest max frames, and expires the
+// buffer together with the grace window. A max of zero or less keeps nothing.
+func (b RedisReplayBuffer) Push(ctx context.Context, sessionId string, max int, ttl time.Duration, frames ...[]byte) error {
+	if len(frames) == 0 || max <= 0 {
+		return nil
+	}
+	key := b.redisKey(sessionId)
+	values := make([]interface{}, len(frames))
+	for i, frame := range frames {
+		values[i] = frame
+	}
+	_, err := b.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.RPush(ctx, key, values...)
+		pipe.LTrim(ctx, key, int64(-max), -1)
+		pipe.Expire(ctx, key, ttl)
+		return nil
+	})
+	return err
+}
+
+// Drain returns the buffered frames in arrival order and empties the buffer.
+func (b RedisReplayBuffer) Drain(ctx context.Context, sessionId string) ([][]byte, error) {
+	key := b.redisKey(sessionId)
+	var lrange *redis.StringSliceCmd
+	_, err := b.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		lrange = pipe.LRange(ctx, key, 0, -1)
+		pipe.Del(ctx, key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	frames := make([][]byte, 0, len(lrange.Val()))
+	for _, s := range lrange.Val() {
+		frames = append(frames, []byte(s))
+	}
+	return frames, nil
+}
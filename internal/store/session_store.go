@@ -2,57 +2,425 @@ package store
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"strings"
 	"time"
 
 	"github.com/jibitesh/request-response-manager/internal/logger"
+	"github.com/jibitesh/request-response-manager/internal/metrics"
 	"github.com/jibitesh/request-response-manager/pkg/instance"
 )
 
 //var ErrNotFound = errors.New("session not found")
 
+var ErrInvalidResumeToken = errors.New("invalid resume token")
+
+// errNotOwned leaves a session alone that another instance has taken over.
+var errNotOwned = errors.New("session not owned by this instance")
+
 type SessionInfo struct {
-	SessionId string             `json:"session_id"`
-	Instance  *instance.Instance `json:"instance"`
-	CreatedAt time.Time          `json:"created_at"`
+	SessionId   string                 `json:"session_id"`
+	UserId      string                 `json:"user_id,omitempty"`
+	Claims      map[string]interface{} `json:"claims,omitempty"`
+	Subprotocol string                 `json:"subprotocol,omitempty"`
+	Instance    *instance.Instance     `json:"instance"`
+	CreatedAt   time.Time              `json:"created_at"`
+	ResumeToken string                 `json:"resume_token,omitempty"`
+	DetachedAt  *time.Time             `json:"detached_at,omitempty"`
+}
+
+func (si *SessionInfo) Detached() bool {
+	return si.DetachedAt != nil
 }
 
 type SessionService struct {
 	instance     *instance.Instance
 	sessionStore SessionStore
+	events       EventPublisher
+	replay       ReplayBuffer
+	topics       TopicStore
+	users        UserIndex
+	acks         AckStore
+	mailbox      Mailbox
 }
 
-func NewSessionService(instance *instance.Instance, store SessionStore) *SessionService {
+func NewSessionService(instance *instance.Instance, store SessionStore, events EventPublisher, replay ReplayBuffer, topics TopicStore, users UserIndex, acks AckStore, mailbox Mailbox) *SessionService {
 	return &SessionService{
 		instance:     instance,
 		sessionStore: store,
+		events:       events,
+		replay:       replay,
+		topics:       topics,
+		users:        users,
+		acks:         acks,
+		mailbox:      mailbox,
+	}
+}
+
+// AddSession registers si as a new session owned by this instance. The caller
+// sets the session id and the connection's identity; ownership, creation time
+// and the resume token are filled in here.
+func (ss *SessionService) AddSession(ctx context.Context, si *SessionInfo) (*SessionInfo, error) {
+	token, err := newResumeToken(si.SessionId)
+	if err != nil {
+		return nil, err
 	}
+	si.Instance = ss.instance
+	si.CreatedAt = time.Now()
+	si.ResumeToken = token
+	if err := ss.sessionStore.Set(ctx, si.SessionId, si); err != nil {
+		logger.Errorf("Error saving session: %v", err)
+		return nil, err
+	}
+	if si.UserId != "" {
+		if err := ss.users.Add(ctx, si.UserId, si.SessionId); err != nil {
+			logger.Errorf("Failed to index sessionId: %s for userId: %s. Error: %v", si.SessionId, si.UserId, err)
+		}
+	}
+	ss.publish(ctx, EventSessionCreated, si.SessionId, ss.instance.Name)
+	return si, nil
 }
 
-func (ss *SessionService) AddSession(ctx context.Context, sessionId string) (bool, error) {
-	si := &SessionInfo{
-		SessionId: sessionId,
-		Instance:  ss.instance,
-		CreatedAt: time.Now(),
+// ResumeSession moves the session named by token to this instance and rotates
+// its token. The session may be detached or still attached to an instance that
+// has not yet noticed the old connection dropped; that instance is returned
+// as superseded so its connection can be closed. A session that belongs to a
+// user can only be resumed by that same user. The claims and subprotocol of
+// the new connection, described by conn, replace the old ones.
+func (ss *SessionService) ResumeSession(ctx context.Context, token string, conn *SessionInfo) (*SessionInfo, *instance.Instance, error) {
+	sessionId, _, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, nil, ErrInvalidResumeToken
+	}
+	next, err := newResumeToken(sessionId)
+	if err != nil {
+		return nil, nil, err
+	}
+	var superseded *instance.Instance
+	si, err := ss.sessionStore.Update(ctx, sessionId, func(si *SessionInfo) (time.Duration, error) {
+		if subtle.ConstantTimeCompare([]byte(si.ResumeToken), []byte(token)) != 1 || si.UserId != conn.UserId {
+			return 0, ErrInvalidResumeToken
+		}
+		superseded = nil
+		if !si.Detached() {
+			superseded = si.Instance
+		}
+		si.Instance = ss.instance
+		si.ResumeToken = next
+		si.DetachedAt = nil
+		si.Claims = conn.Claims
+		si.Subprotocol = conn.Subprotocol
+		return 0, nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil, ErrInvalidResumeToken
+	} else if err != nil {
+		return nil, nil, err
 	}
-	if err := ss.sessionStore.Set(ctx, sessionId, si); err != nil {
-		logger.Error("Error saving session: %v", err)
-		return false, err
+	// The user's index may have expired while the session was detached.
+	if si.UserId != "" {
+		if err := ss.users.Add(ctx, si.UserId, si.SessionId); err != nil {
+			logger.Errorf("Failed to index sessionId: %s for userId: %s. Error: %v", si.SessionId, si.UserId, err)
+		}
 	}
-	return true, nil
+	ss.publish(ctx, EventSessionResumed, sessionId, ss.instance.Name)
+	return si, superseded, nil
+}
+
+// ReleaseSession is called when this instance loses the session's connection.
+// With a grace window the session is kept detached so it can be resumed,
+// otherwise it is removed. Sessions already resumed elsewhere are left alone.
+func (ss *SessionService) ReleaseSession(ctx context.Context, sessionId string, grace time.Duration) error {
+	now := time.Now()
+	si, err := ss.sessionStore.Update(ctx, sessionId, func(si *SessionInfo) (time.Duration, error) {
+		if !si.Instance.Equal(ss.instance) || si.Detached() {
+			return 0, errNotOwned
+		}
+		if grace <= 0 {
+			return -1, nil
+		}
+		si.DetachedAt = &now
+		return grace, nil
+	})
+	if errors.Is(err, ErrNotFound) || errors.Is(err, errNotOwned) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// The detached session expires silently, so retain it for its mail now.
+	ss.retain(ctx, si)
+	if grace <= 0 {
+		ss.dropIndexes(ctx, si)
+		ss.publish(ctx, EventSessionRemoved, sessionId, ss.instance.Name)
+		return nil
+	}
+	ss.publish(ctx, EventSessionDetached, sessionId, ss.instance.Name)
+	return nil
+}
+
+// BufferMessage keeps frame for a detached session until it resumes or its grace window ends.
+func (ss *SessionService) BufferMessage(ctx context.Context, sessionId string, frame []byte, max int, grace time.Duration) error {
+	return ss.replay.Push(ctx, sessionId, max, grace, frame)
+}
+
+func (ss *SessionService) DrainBuffer(ctx context.Context, sessionId string) ([][]byte, error) {
+	return ss.replay.Drain(ctx, sessionId)
+}
+
+// KeepEvents stores the last events written to a streaming session whose
+// connection dropped, since the client may not have received them all.
+func (ss *SessionService) KeepEvents(ctx context.Context, sessionId string, events [][]byte, grace time.Duration) error {
+	return ss.replay.Push(ctx, eventsId(sessionId), len(events), grace, events...)
+}
+
+func (ss *SessionService) DrainEvents(ctx context.Context, sessionId string) ([][]byte, error) {
+	return ss.replay.Drain(ctx, eventsId(sessionId))
+}
+
+func eventsId(sessionId string) string {
+	return sessionId + ":events"
+}
+
+// KeepStream lets a client that reconnects with an event stream's id resume
+// the session with token, once, within the grace window.
+func (ss *SessionService) KeepStream(ctx context.Context, streamId, token string, grace time.Duration) error {
+	if grace <= 0 {
+		return nil
+	}
+	return ss.replay.Push(ctx, streamKey(streamId), 1, grace, []byte(token))
+}
+
+// ClaimStream returns the resume token kept for an event stream, or "" when
+// there is none, and forgets it.
+func (ss *SessionService) ClaimStream(ctx context.Context, streamId string) (string, error) {
+	tokens, err := ss.replay.Drain(ctx, streamKey(streamId))
+	if err != nil || len(tokens) == 0 {
+		return "", err
+	}
+	return string(tokens[0]), nil
+}
+
+func streamKey(streamId string) string {
+	return "stream:" + streamId
 }
 
 func (ss *SessionService) GetSession(ctx context.Context, sessionId string) (*SessionInfo, error) {
 	return ss.sessionStore.Get(ctx, sessionId)
 }
 
+func (ss *SessionService) GetSessions(ctx context.Context, sessionIds []string) (map[string]*SessionInfo, error) {
+	return ss.sessionStore.GetMany(ctx, sessionIds)
+}
+
 func (ss *SessionService) RemoveSession(ctx context.Context, sessionId string) error {
-	return ss.sessionStore.Delete(ctx, sessionId)
+	si, err := ss.sessionStore.Get(ctx, sessionId)
+	if errors.Is(err, ErrNotFound) {
+		si = &SessionInfo{SessionId: sessionId}
+	} else if err != nil {
+		return err
+	}
+	return ss.removeSession(ctx, si)
+}
+
+func (ss *SessionService) removeSession(ctx context.Context, si *SessionInfo) error {
+	if err := ss.sessionStore.Delete(ctx, si.SessionId); err != nil {
+		return err
+	}
+	ss.retain(ctx, si)
+	ss.dropIndexes(ctx, si)
+	ss.publish(ctx, EventSessionRemoved, si.SessionId, ss.instance.Name)
+	return nil
+}
+
+// RevokeSession deletes a session so that its resume token no longer works,
+// neither to resume it nor to reclaim it for its mail.
+func (ss *SessionService) RevokeSession(ctx context.Context, si *SessionInfo) error {
+	if err := ss.sessionStore.Delete(ctx, si.SessionId); err != nil {
+		return err
+	}
+	if err := ss.mailbox.Forget(ctx, si.SessionId); err != nil {
+		logger.Errorf("Failed to forget retained sessionId: %s. Error: %v", si.SessionId, err)
+	}
+	ss.dropIndexes(ctx, si)
+	ss.publish(ctx, EventSessionRemoved, si.SessionId, ss.instance.Name)
+	return nil
+}
+
+// ReapInstance deletes the sessions left behind by a dead instance and returns how many were removed.
+func (ss *SessionService) ReapInstance(ctx context.Context, instanceName string) (int, error) {
+	infos, err := ss.sessionStore.DeleteByInstance(ctx, instanceName)
+	if err != nil {
+		return 0, err
+	}
+	for _, si := range infos {
+		ss.retain(ctx, si)
+		ss.dropIndexes(ctx, si)
+		ss.publish(ctx, EventSessionReaped, si.SessionId, instanceName)
+	}
+	return len(infos), nil
+}
+
+// DropInstance forgets which sessions this instance owns, once it has left
+// the cluster and no reaper will look for them.
+func (ss *SessionService) DropInstance(ctx context.Context) error {
+	return ss.sessionStore.DropInstance(ctx, ss.instance.Name)
 }
 
 func (ss *SessionService) RefreshSession(ctx context.Context, sessionId string) error {
 	return ss.sessionStore.Refresh(ctx, sessionId)
 }
 
+func (ss *SessionService) RefreshSessions(ctx context.Context, sessionIds []string) error {
+	if len(sessionIds) == 0 {
+		return nil
+	}
+	return ss.sessionStore.RefreshMany(ctx, sessionIds)
+}
+
+// RefreshIndexes extends the TTL of the subscriptions of the given sessions
+// and of the session indexes of the given users.
+func (ss *SessionService) RefreshIndexes(ctx context.Context, sessionIds, userIds []string) error {
+	if len(sessionIds) > 0 {
+		if err := ss.topics.Refresh(ctx, sessionIds); err != nil {
+			return err
+		}
+	}
+	if len(userIds) > 0 {
+		return ss.users.Refresh(ctx, userIds)
+	}
+	return nil
+}
+
+func (ss *SessionService) Subscribe(ctx context.Context, sessionId string, topics []string) error {
+	return ss.topics.Subscribe(ctx, sessionId, topics)
+}
+
+func (ss *SessionService) Unsubscribe(ctx context.Context, sessionId string, topics []string) error {
+	return ss.topics.Unsubscribe(ctx, sessionId, topics)
+}
+
+func (ss *SessionService) Subscribers(ctx context.Context, topic string) ([]string, error) {
+	return ss.topics.Subscribers(ctx, topic)
+}
+
+func (ss *SessionService) Topics(ctx context.Context, sessionId string) ([]string, error) {
+	return ss.topics.Topics(ctx, sessionId)
+}
+
+// PruneSubscribers drops sessions that no longer exist from topic.
+func (ss *SessionService) PruneSubscribers(ctx context.Context, topic string, sessionIds []string) {
+	for _, id := range sessionIds {
+		if err := ss.topics.Unsubscribe(ctx, id, []string{topic}); err != nil {
+			logger.Errorf("Failed to prune sessionId: %s from topic: %s. Error: %v", id, topic, err)
+		}
+	}
+}
+
+func (ss *SessionService) UserSessions(ctx context.Context, userId string) ([]string, error) {
+	return ss.users.Sessions(ctx, userId)
+}
+
+// PruneUserSessions drops sessions that no longer exist from the user's index.
+func (ss *SessionService) PruneUserSessions(ctx context.Context, userId string, sessionIds []string) {
+	if err := ss.users.Remove(ctx, userId, sessionIds...); err != nil {
+		logger.Errorf("Failed to prune sessions of userId: %s. Error: %v", userId, err)
+	}
+}
+
+// TrackAck records this instance as the one waiting for messageId's ack.
+func (ss *SessionService) TrackAck(ctx context.Context, messageId string, ttl time.Duration) error {
+	return ss.acks.Track(ctx, messageId, ss.instance, ttl)
+}
+
+// AckOwner returns the instance waiting for messageId's ack.
+func (ss *SessionService) AckOwner(ctx context.Context, messageId string) (*instance.Instance, error) {
+	return ss.acks.Owner(ctx, messageId)
+}
+
+func (ss *SessionService) UntrackAck(ctx context.Context, messageId string) {
+	if err := ss.acks.Remove(ctx, messageId); err != nil {
+		logger.Errorf("Failed to untrack ack of messageId: %s. Error: %v", messageId, err)
+	}
+}
+
+// ReclaimSession re-registers, under its old id, a session removed while its
+// client was away so mail kept for it reaches the client. token must be the
+// session's last resume token.
+func (ss *SessionService) ReclaimSession(ctx context.Context, token string, conn *SessionInfo) (*SessionInfo, error) {
+	sessionId, _, ok := strings.Cut(token, ".")
+	if !ok || !ss.mailbox.Enabled() {
+		return nil, ErrInvalidResumeToken
+	}
+	_, err := ss.mailbox.Reclaim(ctx, sessionId, func(old *SessionInfo) bool {
+		return subtle.ConstantTimeCompare([]byte(old.ResumeToken), []byte(token)) == 1 && old.UserId == conn.UserId
+	})
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrInvalidResumeToken
+	} else if err != nil {
+		return nil, err
+	}
+	conn.SessionId = sessionId
+	return ss.AddSession(ctx, conn)
+}
+
+func (ss *SessionService) MailboxEnabled() bool {
+	return ss.mailbox.Enabled()
+}
+
+func (ss *SessionService) PushMail(ctx context.Context, kind, id string, frame []byte, ttl time.Duration) (string, error) {
+	return ss.mailbox.Push(ctx, kind, id, frame, ttl)
+}
+
+func (ss *SessionService) DrainMail(ctx context.Context, kind, id string) ([]MailEntry, error) {
+	return ss.mailbox.Drain(ctx, kind, id)
+}
+
+func (ss *SessionService) ListMail(ctx context.Context, kind, id string, count int64) ([]MailEntry, int64, error) {
+	return ss.mailbox.List(ctx, kind, id, count)
+}
+
+func (ss *SessionService) PurgeMail(ctx context.Context, kind, id string, entryIds ...string) (int64, error) {
+	return ss.mailbox.Purge(ctx, kind, id, entryIds...)
+}
+
+// retain keeps a removed session reclaimable while mail may be kept for it.
+func (ss *SessionService) retain(ctx context.Context, si *SessionInfo) {
+	if err := ss.mailbox.Retain(ctx, si); err != nil {
+		logger.Errorf("Failed to retain removed sessionId: %s. Error: %v", si.SessionId, err)
+	}
+}
+
+// dropIndexes removes a deleted session from the secondary indexes.
+func (ss *SessionService) dropIndexes(ctx context.Context, si *SessionInfo) {
+	if err := ss.topics.RemoveSession(ctx, si.SessionId); err != nil {
+		logger.Errorf("Failed to remove subscriptions of sessionId: %s. Error: %v", si.SessionId, err)
+	}
+	if si.UserId != "" {
+		if err := ss.users.Remove(ctx, si.UserId, si.SessionId); err != nil {
+			logger.Errorf("Failed to unindex sessionId: %s for userId: %s. Error: %v", si.SessionId, si.UserId, err)
+		}
+	}
+}
+
 func (ss *SessionService) Instance() *instance.Instance {
 	return ss.instance
 }
+
+func (ss *SessionService) publish(ctx context.Context, typ, sessionId, instanceName string) {
+	metrics.SessionEvents.Inc(typ)
+	ev := &SessionEvent{Type: typ, SessionId: sessionId, Instance: instanceName, Ts: time.Now()}
+	if err := ss.events.Publish(ctx, ev); err != nil {
+		logger.Errorf("Failed to publish %s event for sessionId: %s. Error: %v", typ, sessionId, err)
+	}
+}
+
+func newResumeToken(sessionId string) (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return sessionId + "." + base64.RawURLEncoding.EncodeToString(b), nil
+}
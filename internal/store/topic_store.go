@@ -0,0 +1,97 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jibitesh/request-response-manager/internal/config"
+	"github.com/redis/go-redis/v9"
+)
+
+type TopicStore interface {
+	Subscribe(ctx context.Context, sessionId string, topics []string) error
+	Unsubscribe(ctx context.Context, sessionId string, topics []string) error
+	Subscribers(ctx context.Context, topic string) ([]string, error)
+	Topics(ctx context.Context, sessionId string) ([]string, error)
+	RemoveSession(ctx context.Context, sessionId string) error
+	Refresh(ctx context.Context, sessionIds []string) error
+}
+
+// RedisTopicStore keeps topic->sessions sets for publishing and
+// session->topics sets so a session's subscriptions can be dropped with it.
+// The session->topics sets expire with the session TTL unless refreshed, so
+// a session that expires silently leaves none behind; topic->sessions sets
+// are pruned of such sessions when published to.
+type RedisTopicStore struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+func NewRedisTopicStore(cfg *config.Config, client *redis.Client) *RedisTopicStore {
+	return &RedisTopicStore{client: client, ttl: cfg.Redis.Timeout * time.Minute}
+}
+
+func (t RedisTopicStore) topicKey(topic string) string {
+	return fmt.Sprintf("topic:%s", topic)
+}
+
+func (t RedisTopicStore) sessionKey(sessionId string) string {
+	return fmt.Sprintf("session:%s:topics", sessionId)
+}
+
+func (t RedisTopicStore) Subscribe(ctx context.Context, sessionId string, topics []string) error {
+	_, err := t.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, topic := range topics {
+			pipe.SAdd(ctx, t.topicKey(topic), sessionId)
+			pipe.SAdd(ctx, t.sessionKey(sessionId), topic)
+		}
+		pipe.Expire(ctx, t.sessionKey(sessionId), t.ttl)
+		return nil
+	})
+	return err
+}
+
+func (t RedisTopicStore) Unsubscribe(ctx context.Context, sessionId string, topics []string) error {
+	_, err := t.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, topic := range topics {
+			pipe.SRem(ctx, t.topicKey(topic), sessionId)
+			pipe.SRem(ctx, t.sessionKey(sessionId), topic)
+		}
+		return nil
+	})
+	return err
+}
+
+func (t RedisTopicStore) Subscribers(ctx context.Context, topic string) ([]string, error) {
+	return t.client.SMembers(ctx, t.topicKey(topic)).Result()
+}
+
+func (t RedisTopicStore) Topics(ctx context.Context, sessionId string) ([]string, error) {
+	return t.client.SMembers(ctx, t.sessionKey(sessionId)).Result()
+}
+
+func (t RedisTopicStore) RemoveSession(ctx context.Context, sessionId string) error {
+	topics, err := t.Topics(ctx, sessionId)
+	if err != nil {
+		return err
+	}
+	_, err = t.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, topic := range topics {
+			pipe.SRem(ctx, t.topicKey(topic), sessionId)
+		}
+		pipe.Del(ctx, t.sessionKey(sessionId))
+		return nil
+	})
+	return err
+}
+
+func (t RedisTopicStore) Refresh(ctx context.Context, sessionIds []string) error {
+	_, err := t.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, id := range sessionIds {
+			pipe.Expire(ctx, t.sessionKey(id), t.ttl)
+		}
+		return nil
+	})
+	return err
+}
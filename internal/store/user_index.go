@@ -0,0 +1,67 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jibitesh/request-response-manager/internal/config"
+	"github.com/redis/go-redis/v9"
+)
+
+// UserIndex maps a user id to the ids of that user's sessions. A session that
+// expires silently is not removed from it, so each user's index expires with
+// the session TTL unless a connected session of the user refreshes it.
+type UserIndex interface {
+	Add(ctx context.Context, userId, sessionId string) error
+	Remove(ctx context.Context, userId string, sessionIds ...string) error
+	Sessions(ctx context.Context, userId string) ([]string, error)
+	Refresh(ctx context.Context, userIds []string) error
+}
+
+type RedisUserIndex struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+func NewRedisUserIndex(cfg *config.Config, client *redis.Client) *RedisUserIndex {
+	return &RedisUserIndex{client: client, ttl: cfg.Redis.Timeout * time.Minute}
+}
+
+func (u RedisUserIndex) redisKey(userId string) string {
+	return fmt.Sprintf("user:%s:sessions", userId)
+}
+
+func (u RedisUserIndex) Add(ctx context.Context, userId, sessionId string) error {
+	_, err := u.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, u.redisKey(userId), sessionId)
+		pipe.Expire(ctx, u.redisKey(userId), u.ttl)
+		return nil
+	})
+	return err
+}
+
+func (u RedisUserIndex) Remove(ctx context.Context, userId string, sessionIds ...string) error {
+	if len(sessionIds) == 0 {
+		return nil
+	}
+	members := make([]interface{}, len(sessionIds))
+	for i, id := range sessionIds {
+		members[i] = id
+	}
+	return u.client.SRem(ctx, u.redisKey(userId), members...).Err()
+}
+
+func (u RedisUserIndex) Sessions(ctx context.Context, userId string) ([]string, error) {
+	return u.client.SMembers(ctx, u.redisKey(userId)).Result()
+}
+
+func (u RedisUserIndex) Refresh(ctx context.Context, userIds []string) error {
+	_, err := u.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, id := range userIds {
+			pipe.Expire(ctx, u.redisKey(id), u.ttl)
+		}
+		return nil
+	})
+	return err
+}
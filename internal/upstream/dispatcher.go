@@ -0,0 +1,161 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/jibitesh/request-response-manager/internal/config"
+	"github.com/jibitesh/request-response-manager/internal/logger"
+	"github.com/jibitesh/request-response-manager/pkg/instance"
+)
+
+var ErrNoRoute = errors.New("upstream: no route for message")
+
+const (
+	HeaderSessionId  = "X-Session-Id"
+	HeaderInstance   = "X-Instance"
+	HeaderRoute      = "X-Route"
+	HeaderReceivedAt = "X-Received-At"
+)
+
+const defaultRouteTimeout = 10 * time.Second
+
+// Dispatcher POSTs client-originated messages to the upstream service selected
+// by the value of the configured route field in the message payload. Binary
+// messages have no fields to route by and go to the catch-all route.
+type Dispatcher struct {
+	routeField   string
+	routes       map[string]config.UpstreamRoute
+	defaultRoute *config.UpstreamRoute
+	instance     *instance.Instance
+	client       *http.Client
+}
+
+type Result struct {
+	Route string
+	Reply []byte
+	// ContentType is the media type of Reply as the upstream declared it.
+	ContentType string
+}
+
+func NewDispatcher(cfg *config.Config, instance *instance.Instance) *Dispatcher {
+	d := &Dispatcher{
+		routeField: cfg.Upstream.RouteField,
+		routes:     make(map[string]config.UpstreamRoute),
+		instance:   instance,
+		client:     &http.Client{},
+	}
+	for _, route := range cfg.Upstream.Routes {
+		if route.Timeout <= 0 {
+			route.Timeout = defaultRouteTimeout
+		}
+		if route.Match == "*" {
+			r := route
+			d.defaultRoute = &r
+			continue
+		}
+		d.routes[route.Match] = route
+	}
+	return d
+}
+
+func (d *Dispatcher) Enabled() bool {
+	return len(d.routes) > 0 || d.defaultRoute != nil
+}
+
+func (d *Dispatcher) route(message []byte, binary bool) (config.UpstreamRoute, bool) {
+	var fields map[string]interface{}
+	if !binary && json.Unmarshal(message, &fields) == nil {
+		if key, ok := fields[d.routeField].(string); ok {
+			if route, ok := d.routes[key]; ok {
+				return route, true
+			}
+		}
+	}
+	if d.defaultRoute != nil {
+		return *d.defaultRoute, true
+	}
+	return config.UpstreamRoute{}, false
+}
+
+// Dispatch sends message to its upstream, retrying transport errors and 5xx
+// responses. The upstream response body is returned only for routes that
+// reply to the client. A content type marks message as binary data of that
+// type; text messages are sent as JSON or plain text.
+func (d *Dispatcher) Dispatch(ctx context.Context, sessionId string, message []byte, contentType string) (*Result, error) {
+	route, ok := d.route(message, contentType != "")
+	if !ok {
+		return nil, ErrNoRoute
+	}
+
+	receivedAt := time.Now().UTC().Format(time.RFC3339Nano)
+	var lastErr error
+	for attempt := 0; attempt <= route.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(time.Duration(attempt) * route.RetryBackoff):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		reply, replyType, retry, err := d.post(ctx, route, sessionId, receivedAt, message, contentType)
+		if err == nil {
+			res := &Result{Route: route.Name}
+			if route.ReplyToClient {
+				res.Reply, res.ContentType = reply, replyType
+			}
+			return res, nil
+		}
+		lastErr = err
+		if !retry {
+			break
+		}
+		logger.Infof("Retrying upstream %s for sessionId: %s after attempt %d. Error: %v", route.Name, sessionId, attempt+1, err)
+	}
+	return nil, lastErr
+}
+
+func (d *Dispatcher) post(ctx context.Context, route config.UpstreamRoute, sessionId, receivedAt string, message []byte, contentType string) ([]byte, string, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, route.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, route.URL, bytes.NewReader(message))
+	if err != nil {
+		return nil, "", false, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	} else if json.Valid(message) {
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	req.Header.Set(HeaderSessionId, sessionId)
+	req.Header.Set(HeaderInstance, d.instance.Name)
+	req.Header.Set(HeaderRoute, route.Name)
+	req.Header.Set(HeaderReceivedAt, receivedAt)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, "", true, fmt.Errorf("upstream %s: %w", route.Name, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", true, fmt.Errorf("upstream %s: read response: %w", route.Name, err)
+	}
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return nil, "", true, fmt.Errorf("upstream %s: status %d", route.Name, resp.StatusCode)
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, "", false, fmt.Errorf("upstream %s: status %d", route.Name, resp.StatusCode)
+	}
+	return body, resp.Header.Get("Content-Type"), false, nil
+}
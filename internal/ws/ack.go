@@ -0,0 +1,315 @@
+package ws
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/jibitesh/request-response-manager/internal/logger"
+	"github.com/jibitesh/request-response-manager/internal/message"
+	"github.com/jibitesh/request-response-manager/internal/store"
+)
+
+type ackRequest struct {
+	SessionId string `json:"sessionId"`
+	MessageId string `json:"messageId"`
+}
+
+// unacked is a message sent with Ack set that the client has not acked yet.
+type unacked struct {
+	sessionId   string
+	env         *message.Envelope
+	callbackURL string
+	attempts    int
+	nextRetry   time.Time
+	// buffered is set while a copy waits in the replay buffer of the
+	// detached session, so retries do not pile up duplicates there.
+	buffered bool
+	expiry   *time.Timer
+	done     chan DeliveryResult
+}
+
+// ackTracker holds the messages this instance is waiting for acks on.
+type ackTracker struct {
+	mu      sync.Mutex
+	entries map[string]*unacked
+}
+
+func newAckTracker() *ackTracker {
+	return &ackTracker{entries: make(map[string]*unacked)}
+}
+
+// add tracks u and arms expire to run once timeout passes.
+func (t *ackTracker) add(u *unacked, timeout time.Duration, expire func()) {
+	t.mu.Lock()
+	t.entries[u.env.Id] = u
+	u.expiry = time.AfterFunc(timeout, expire)
+	t.mu.Unlock()
+}
+
+// finish removes messageId and returns its entry, or nil when it was already
+// settled. Only acks from the session the message was sent to count.
+func (t *ackTracker) finish(sessionId, messageId string) *unacked {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u, ok := t.entries[messageId]
+	if !ok || (sessionId != "" && u.sessionId != sessionId) {
+		return nil
+	}
+	delete(t.entries, messageId)
+	return u
+}
+
+// due returns the entries whose retry time has come and that still have
+// retries left, and schedules their next retry.
+func (t *ackTracker) due(now time.Time, interval time.Duration, maxRetries int) []*unacked {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var due []*unacked
+	for _, u := range t.entries {
+		if u.attempts >= maxRetries || now.Before(u.nextRetry) {
+			continue
+		}
+		u.attempts++
+		u.nextRetry = now.Add(interval)
+		due = append(due, u)
+	}
+	return due
+}
+
+// resumed returns the entries of sessionId that must be resent after the
+// session resumed here. Copies held in the replay buffer were just replayed.
+func (t *ackTracker) resumed(sessionId string, now time.Time, interval time.Duration) []*unacked {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var resend []*unacked
+	for _, u := range t.entries {
+		if u.sessionId != sessionId {
+			continue
+		}
+		u.nextRetry = now.Add(interval)
+		if u.buffered {
+			u.buffered = false
+			continue
+		}
+		resend = append(resend, u)
+	}
+	return resend
+}
+
+func (t *ackTracker) setBuffered(u *unacked, buffered bool) {
+	t.mu.Lock()
+	u.buffered = buffered
+	t.mu.Unlock()
+}
+
+func (t *ackTracker) isBuffered(u *unacked) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return u.buffered
+}
+
+// SendWithAck delivers env and tracks it until the client acks it, it expires
+// after timeout or the session goes away. A message that could not be
+// delivered or buffered at all is not tracked and its result is returned with
+// a nil channel; otherwise the result is pending and the final one is sent on
+// the returned channel and, when callbackURL is set, posted there.
+func (cm *ConnectionManager) SendWithAck(ctx context.Context, sessionId string, env *message.Envelope, timeout time.Duration, callbackURL string) (DeliveryResult, <-chan DeliveryResult) {
+	env.Ack = true
+	u := &unacked{
+		sessionId:   sessionId,
+		env:         env,
+		callbackURL: callbackURL,
+		nextRetry:   time.Now().Add(cm.cfg.Ack.RetryInterval),
+		done:        make(chan DeliveryResult, 1),
+	}
+	// Track before sending so an ack racing the delivery result is not lost.
+	cm.acks.add(u, timeout, func() {
+		cm.settle("", env.Id, StatusExpired, "")
+	})
+	if err := cm.sessionService.TrackAck(ctx, env.Id, timeout); err != nil {
+		logger.Errorf("Failed to track ack of messageId: %s. Error: %v", env.Id, err)
+	}
+
+	res := cm.Deliver(ctx, sessionId, env)
+	switch res.Status {
+	case StatusDelivered, StatusBuffered:
+		cm.acks.setBuffered(u, res.Status == StatusBuffered)
+		return DeliveryResult{SessionId: sessionId, MessageId: env.Id, Status: StatusPending}, u.done
+	default:
+		if cm.acks.finish("", env.Id) != nil {
+			u.expiry.Stop()
+			cm.sessionService.UntrackAck(context.Background(), env.Id)
+		}
+		return res, nil
+	}
+}
+
+// settle ends tracking of messageId with status and reports the final result.
+// sessionId, when set, must be the session the message was sent to.
+func (cm *ConnectionManager) settle(sessionId, messageId string, status DeliveryStatus, errMsg string) bool {
+	u := cm.acks.finish(sessionId, messageId)
+	if u == nil {
+		return false
+	}
+	u.expiry.Stop()
+	cm.sessionService.UntrackAck(context.Background(), messageId)
+
+	res := DeliveryResult{SessionId: u.sessionId, MessageId: messageId, Status: status, Error: errMsg}
+	if status != StatusAcked {
+		logger.Infof("Message: %s to sessionId: %s settled as %s after %d retries", messageId, u.sessionId, status, u.attempts)
+	}
+	u.done <- res
+	if u.callbackURL != "" {
+		go cm.postCallback(u.callbackURL, res)
+	}
+	return true
+}
+
+// handleAck settles a message acked by a local client. Acks for messages sent
+// through another instance are forwarded to it.
+func (cm *ConnectionManager) handleAck(sessionId, messageId string) {
+	if cm.settle(sessionId, messageId, StatusAcked, "") {
+		return
+	}
+	ctx := context.Background()
+	owner, err := cm.sessionService.AckOwner(ctx, messageId)
+	if errors.Is(err, store.ErrNotFound) || (err == nil && owner.Equal(cm.sessionService.Instance())) {
+		logger.Infof("Dropping ack of unknown messageId: %s from sessionId: %s", messageId, sessionId)
+		return
+	} else if err != nil {
+		logger.Errorf("Failed to look up ack owner of messageId: %s. Error: %v", messageId, err)
+		return
+	}
+	req := ackRequest{SessionId: sessionId, MessageId: messageId}
+	status, err := cm.peers.Post(ctx, owner, "/internal/ack", req, nil)
+	if err == nil && status != http.StatusNoContent && status != http.StatusOK {
+		err = fmt.Errorf("peer answered %d", status)
+	}
+	if err != nil {
+		logger.Errorf("Failed to forward ack of messageId: %s to %s. Error: %v", messageId, owner.Addr(), err)
+	}
+}
+
+// Handles POST /internal/ack {sessionId, messageId} from the instance a client acked on.
+func (cm *ConnectionManager) HandleInternalAck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req ackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MessageId == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if !cm.settle(req.SessionId, req.MessageId, StatusAcked, "") {
+		http.Error(w, "Unknown message", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// retransmit sends an unacked message again wherever its session now is.
+func (cm *ConnectionManager) retransmit(ctx context.Context, u *unacked) {
+	si, err := cm.sessionService.GetSession(ctx, u.sessionId)
+	if errors.Is(err, store.ErrNotFound) {
+		cm.settle("", u.env.Id, StatusFailed, "session gone")
+		return
+	} else if err != nil {
+		logger.Errorf("Failed to look up sessionId: %s for retransmit. Error: %v", u.sessionId, err)
+		return
+	}
+	if si.Detached() && cm.acks.isBuffered(u) {
+		return
+	}
+
+	res := cm.Deliver(ctx, u.sessionId, u.env)
+	switch res.Status {
+	case StatusDelivered, StatusBuffered:
+		cm.acks.setBuffered(u, res.Status == StatusBuffered)
+	case StatusSessionGone:
+		cm.settle("", u.env.Id, StatusFailed, "session gone")
+	default:
+		logger.Infof("Retransmit of messageId: %s to sessionId: %s failed. Status: %s", u.env.Id, u.sessionId, res.Status)
+	}
+}
+
+// resendUnacked resends the messages still unacked by a session that just
+// resumed on this instance.
+func (cm *ConnectionManager) resendUnacked(ctx context.Context, sessionId string) bool {
+	for _, u := range cm.acks.resumed(sessionId, time.Now(), cm.cfg.Ack.RetryInterval) {
+		if res := cm.deliverLocal(ctx, sessionId, u.env); res.Status != StatusDelivered {
+			logger.Errorf("Failed to resend unacked messageId: %s to sessionId: %s. Status: %s", u.env.Id, sessionId, res.Status)
+			return false
+		}
+	}
+	return true
+}
+
+// ackLoop retransmits unacked messages every retry interval until
+// CloseAllConnections.
+func (cm *ConnectionManager) ackLoop() {
+	ticker := time.NewTicker(cm.cfg.Ack.RetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cm.stop:
+			return
+		case now := <-ticker.C:
+			for _, u := range cm.acks.due(now, cm.cfg.Ack.RetryInterval, cm.cfg.Ack.MaxRetries) {
+				cm.retransmit(context.Background(), u)
+			}
+		}
+	}
+}
+
+// validCallback reports whether raw is an absolute http or https URL whose
+// host is allowed by ack.callbackHosts, which accepts any host when empty.
+// The patterns are those of connection.allowedOrigins.
+func (cm *ConnectionManager) validCallback(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" || u.User != nil {
+		return false
+	}
+	hosts := cm.cfg.Ack.CallbackHosts
+	if len(hosts) == 0 {
+		return true
+	}
+	for _, pattern := range hosts {
+		if matchOrigin(pattern, u) {
+			return true
+		}
+	}
+	return false
+}
+
+func (cm *ConnectionManager) postCallback(callbackURL string, res DeliveryResult) {
+	b, _ := json.Marshal(res)
+	resp, err := cm.callbacks.Post(callbackURL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		logger.Errorf("Failed to post ack callback for messageId: %s to %s. Error: %v", res.MessageId, callbackURL, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logger.Errorf("Ack callback for messageId: %s to %s returned %d", res.MessageId, callbackURL, resp.StatusCode)
+	}
+}
+
+// ackTimeout returns the requested ack timeout, bounded by the configured maximum.
+func (cm *ConnectionManager) ackTimeout(ms int64) time.Duration {
+	if ms <= 0 {
+		return cm.cfg.Ack.Timeout
+	}
+	timeout := time.Duration(ms) * time.Millisecond
+	if max := cm.cfg.Ack.MaxTimeout; max > 0 && timeout > max {
+		return max
+	}
+	return timeout
+}
@@ -0,0 +1,431 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jibitesh/request-response-manager/internal/logger"
+	"github.com/jibitesh/request-response-manager/internal/store"
+	"github.com/jibitesh/request-response-manager/pkg/instance"
+)
+
+// CloseKicked is sent to a client an administrator disconnects, unless the
+// request names another code.
+const CloseKicked = 4003
+
+// CloseSuperseded is sent to a connection whose session was resumed by a
+// client on another instance.
+const CloseSuperseded = 4004
+
+// maxCloseReason is the longest reason that fits in a websocket close frame.
+const maxCloseReason = 123
+
+type sessionDetails struct {
+	SessionId   string                 `json:"sessionId"`
+	UserId      string                 `json:"userId,omitempty"`
+	Claims      map[string]interface{} `json:"claims,omitempty"`
+	Subprotocol string                 `json:"subprotocol,omitempty"`
+	Instance    string                 `json:"instance"`
+	CreatedAt   *time.Time             `json:"createdAt,omitempty"`
+	DetachedAt  *time.Time             `json:"detachedAt,omitempty"`
+	// Connection is set while a client is connected to the session.
+	Connection *connectionDetails `json:"connection,omitempty"`
+}
+
+type connectionDetails struct {
+	Transport    string    `json:"transport"`
+	ConnectedAt  time.Time `json:"connectedAt"`
+	RemoteAddr   string    `json:"remoteAddr,omitempty"`
+	UserAgent    string    `json:"userAgent,omitempty"`
+	LastActivity time.Time `json:"lastActivity"`
+	MessagesIn   int64     `json:"messagesIn"`
+	MessagesOut  int64     `json:"messagesOut"`
+	BytesIn      int64     `json:"bytesIn"`
+	BytesOut     int64     `json:"bytesOut"`
+	Queued       int       `json:"queued"`
+}
+
+func (s *Session) connection() *connectionDetails {
+	return &connectionDetails{
+		Transport:    s.Transport(),
+		ConnectedAt:  s.connectedAt,
+		RemoteAddr:   s.remoteAddr,
+		UserAgent:    s.userAgent,
+		LastActivity: s.LastActivity(),
+		MessagesIn:   s.messagesIn.Load(),
+		MessagesOut:  s.messagesOut.Load(),
+		BytesIn:      s.bytesIn.Load(),
+		BytesOut:     s.bytesOut.Load(),
+		Queued:       len(s.queue),
+	}
+}
+
+type instanceError struct {
+	Instance string `json:"instance"`
+	Error    string `json:"error"`
+}
+
+type sessionPage struct {
+	Sessions []sessionDetails `json:"sessions"`
+	// NextCursor is passed back as ?cursor= for the next page.
+	NextCursor string `json:"nextCursor,omitempty"`
+	// Errors names the instances whose sessions could not be listed.
+	Errors []instanceError `json:"errors,omitempty"`
+}
+
+type listSessionsRequest struct {
+	After string `json:"after,omitempty"`
+	Limit int    `json:"limit"`
+}
+
+type listSessionsResult struct {
+	Sessions []sessionDetails `json:"sessions"`
+	More     bool             `json:"more"`
+}
+
+// adminRequest names a session for the internal admin calls. Code and Reason
+// are only used to disconnect it.
+type adminRequest struct {
+	SessionId string `json:"sessionId"`
+	Code      int    `json:"code,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// listLocal returns up to limit of this instance's connections, ordered by
+// session id and starting after the given one.
+func (cm *ConnectionManager) listLocal(after string, limit int) listSessionsResult {
+	cm.connMu.RLock()
+	sessions := make([]*Session, 0, len(cm.connections))
+	for id, sess := range cm.connections {
+		if id > after {
+			sessions = append(sessions, sess)
+		}
+	}
+	cm.connMu.RUnlock()
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].id < sessions[j].id })
+
+	res := listSessionsResult{Sessions: make([]sessionDetails, 0, min(len(sessions), limit))}
+	if len(sessions) > limit {
+		sessions, res.More = sessions[:limit], true
+	}
+	self := cm.sessionService.Instance().Name
+	for _, sess := range sessions {
+		res.Sessions = append(res.Sessions, sessionDetails{
+			SessionId:   sess.id,
+			UserId:      sess.userId,
+			Claims:      sess.claims,
+			Subprotocol: sess.subprotocol,
+			Instance:    self,
+			Connection:  sess.connection(),
+		})
+	}
+	return res
+}
+
+// ListSessions pages through the live connections of this instance or, when
+// cluster is set, of every instance in name order. A cursor is
+// "<instance>:<last session id>" of the previous page.
+func (cm *ConnectionManager) ListSessions(ctx context.Context, registry store.InstanceRegistry, cluster bool, cursor string, limit int) (*sessionPage, error) {
+	self := cm.sessionService.Instance()
+	instances := []instance.Instance{*self}
+	if cluster {
+		infos, err := registry.List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			if !info.Instance.Equal(self) {
+				instances = append(instances, info.Instance)
+			}
+		}
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Name < instances[j].Name })
+
+	var from, after string
+	if i := strings.LastIndex(cursor, ":"); i >= 0 {
+		from, after = cursor[:i], cursor[i+1:]
+	}
+	page := &sessionPage{Sessions: make([]sessionDetails, 0, limit)}
+	for i, ins := range instances {
+		if ins.Name < from {
+			continue
+		}
+		req := listSessionsRequest{Limit: limit - len(page.Sessions)}
+		if ins.Name == from {
+			req.After = after
+		}
+		var res listSessionsResult
+		if ins.Equal(self) {
+			res = cm.listLocal(req.After, req.Limit)
+		} else {
+			status, err := cm.peers.Post(ctx, &ins, "/internal/admin/sessions", req, &res)
+			if err == nil && status != http.StatusOK {
+				err = fmt.Errorf("peer answered %d", status)
+			}
+			if err != nil {
+				logger.Errorf("Failed to list sessions of %s. Error: %v", ins.Addr(), err)
+				page.Errors = append(page.Errors, instanceError{Instance: ins.Name, Error: err.Error()})
+				continue
+			}
+		}
+		page.Sessions = append(page.Sessions, res.Sessions...)
+		if len(page.Sessions) >= limit {
+			if res.More || i < len(instances)-1 {
+				page.NextCursor = ins.Name + ":" + page.Sessions[len(page.Sessions)-1].SessionId
+			}
+			break
+		}
+	}
+	return page, nil
+}
+
+// HandleAdminSessions serves GET /admin/sessions?scope=cluster|local&limit=&cursor=,
+// listing live connections with their details.
+func (cm *ConnectionManager) HandleAdminSessions(registry store.InstanceRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		var cluster bool
+		switch query.Get("scope") {
+		case "", "cluster":
+			cluster = true
+		case "local":
+		default:
+			http.Error(w, "Invalid scope", http.StatusBadRequest)
+			return
+		}
+		limit := cm.cfg.Admin.PageSize
+		if v := query.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				http.Error(w, "Invalid limit", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		if max := cm.cfg.Admin.MaxPageSize; max > 0 && limit > max {
+			limit = max
+		}
+
+		page, err := cm.ListSessions(r.Context(), registry, cluster, query.Get("cursor"), limit)
+		if err != nil {
+			logger.Errorf("Failed to list sessions. Error: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(page)
+	}
+}
+
+// adminSession looks up the session named by an /admin/sessions/{id} path.
+func (cm *ConnectionManager) adminSession(w http.ResponseWriter, r *http.Request) (*store.SessionInfo, bool) {
+	sessionId := strings.TrimPrefix(r.URL.Path, "/admin/sessions/")
+	if sessionId == "" || strings.Contains(sessionId, "/") {
+		http.Error(w, "Invalid session path format", http.StatusBadRequest)
+		return nil, false
+	}
+	si, err := cm.sessionService.GetSession(r.Context(), sessionId)
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return nil, false
+	} else if err != nil {
+		logger.Errorf("Failed to look up sessionId: %s. Error: %v", sessionId, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil, false
+	}
+	return si, true
+}
+
+// HandleAdminSession serves GET /admin/sessions/{id}. The connection details
+// come from the instance that owns the session.
+func (cm *ConnectionManager) HandleAdminSession(w http.ResponseWriter, r *http.Request) {
+	si, ok := cm.adminSession(w, r)
+	if !ok {
+		return
+	}
+	details := sessionDetails{
+		SessionId:   si.SessionId,
+		UserId:      si.UserId,
+		Claims:      si.Claims,
+		Subprotocol: si.Subprotocol,
+		Instance:    si.Instance.Name,
+		CreatedAt:   &si.CreatedAt,
+		DetachedAt:  si.DetachedAt,
+	}
+	if !si.Detached() {
+		if si.Instance.Equal(cm.sessionService.Instance()) {
+			if sess := cm.session(si.SessionId); sess != nil {
+				details.Connection = sess.connection()
+			}
+		} else {
+			var conn connectionDetails
+			status, err := cm.peers.Post(r.Context(), si.Instance, "/internal/admin/session", adminRequest{SessionId: si.SessionId}, &conn)
+			switch {
+			case status == http.StatusOK && err == nil:
+				details.Connection = &conn
+			case status == http.StatusNotFound:
+			default:
+				logger.Errorf("Failed to fetch sessionId: %s from %s. Status: %d. Error: %v", si.SessionId, si.Instance.Addr(), status, err)
+				http.Error(w, "Owner instance unreachable", http.StatusBadGateway)
+				return
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(details)
+}
+
+// HandleAdminDisconnect serves DELETE /admin/sessions/{id}?code=&reason=&revoke=,
+// closing the session's connection on whichever instance owns it. By default
+// the session is revoked as well, so the client has to start a new one;
+// revoke=false lets it resume the session like after any dropped connection.
+func (cm *ConnectionManager) HandleAdminDisconnect(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	req := adminRequest{Code: CloseKicked, Reason: query.Get("reason")}
+	revoke := true
+	if v := query.Get("revoke"); v != "" {
+		var err error
+		if revoke, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "Invalid revoke", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("code"); v != "" {
+		code, err := strconv.Atoi(v)
+		if err != nil || !validCloseCode(code) {
+			http.Error(w, "Invalid close code", http.StatusBadRequest)
+			return
+		}
+		req.Code = code
+	}
+	if req.Reason == "" {
+		req.Reason = "disconnected by administrator"
+	}
+	if len(req.Reason) > maxCloseReason {
+		http.Error(w, "Close reason too long", http.StatusBadRequest)
+		return
+	}
+	si, ok := cm.adminSession(w, r)
+	if !ok {
+		return
+	}
+	// Revoking first leaves nothing to resume once the client sees the close.
+	if revoke {
+		if err := cm.sessionService.RevokeSession(r.Context(), si); err != nil {
+			logger.Errorf("Failed to revoke sessionId: %s. Error: %v", si.SessionId, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		logger.Infof("Revoked sessionId: %s", si.SessionId)
+	}
+	if si.Detached() {
+		if revoke {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		http.Error(w, "Session not connected", http.StatusConflict)
+		return
+	}
+	req.SessionId = si.SessionId
+
+	var status int
+	if si.Instance.Equal(cm.sessionService.Instance()) {
+		status = cm.disconnectLocal(req)
+	} else {
+		var err error
+		if status, err = cm.peers.Post(r.Context(), si.Instance, "/internal/admin/disconnect", req, nil); err != nil {
+			logger.Errorf("Failed to forward disconnect of sessionId: %s to %s. Error: %v", si.SessionId, si.Instance.Addr(), err)
+			http.Error(w, "Owner instance unreachable", http.StatusBadGateway)
+			return
+		}
+	}
+	if status == http.StatusNotFound {
+		if revoke {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		http.Error(w, "Session not connected", http.StatusConflict)
+		return
+	}
+	if status != http.StatusNoContent {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	logger.Infof("Disconnected sessionId: %s on %s with code: %d reason: %s", si.SessionId, si.Instance.Name, req.Code, req.Reason)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validCloseCode reports whether code may be sent in a close frame: a normal
+// closure or one of the codes registered for libraries and applications.
+func validCloseCode(code int) bool {
+	return code == 1000 || (code >= 3000 && code <= 4999)
+}
+
+func (cm *ConnectionManager) disconnectLocal(req adminRequest) int {
+	sess := cm.session(req.SessionId)
+	if sess == nil {
+		return http.StatusNotFound
+	}
+	sess.CloseWithReason(req.Code, req.Reason)
+	return http.StatusNoContent
+}
+
+// Handles POST /internal/admin/sessions {after, limit} from peer instances, listing local connections.
+func (cm *ConnectionManager) HandleInternalAdminSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req listSessionsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Limit <= 0 {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(cm.listLocal(req.After, req.Limit))
+}
+
+// Handles POST /internal/admin/session {sessionId} from peer instances with a local connection's details.
+func (cm *ConnectionManager) HandleInternalAdminSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req adminRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	sess := cm.session(req.SessionId)
+	if sess == nil {
+		http.Error(w, "Session not connected", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(sess.connection())
+}
+
+// Handles POST /internal/admin/disconnect {sessionId, code, reason} from peer instances, for local sessions only.
+func (cm *ConnectionManager) HandleInternalAdminDisconnect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req adminRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !validCloseCode(req.Code) || len(req.Reason) > maxCloseReason {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if status := cm.disconnectLocal(req); status != http.StatusNoContent {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,74 @@
+package ws
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/jibitesh/request-response-manager/internal/auth"
+	"github.com/jibitesh/request-response-manager/internal/logger"
+)
+
+// CloseTokenExpired is sent when the token a client connected with expires.
+const CloseTokenExpired = 4001
+
+type identity struct {
+	userId    string
+	claims    map[string]interface{}
+	expiresAt time.Time
+	// bearer is set when the token came in Sec-WebSocket-Protocol.
+	bearer     bool
+	remoteAddr string
+	userAgent  string
+}
+
+// authenticate identifies the client of an upgrade request. Without JWT auth
+// the user id is taken from the user header, if the operator configured one
+// that a trusted proxy sets.
+func (cm *ConnectionManager) authenticate(r *http.Request) (*identity, error) {
+	if cm.verifier == nil {
+		id := &identity{remoteAddr: r.RemoteAddr, userAgent: r.UserAgent()}
+		if header := cm.cfg.Auth.UserHeader; header != "" {
+			id.userId = r.Header.Get(header)
+		}
+		return id, nil
+	}
+
+	jwtCfg := cm.cfg.Auth.JWT
+	token, fromProtocol := auth.TokenFromRequest(r, jwtCfg.QueryParam)
+	if token == "" {
+		logger.Infof("auth: rejected upgrade from %s. Error: %v", r.RemoteAddr, auth.ErrMissingToken)
+		return nil, auth.ErrMissingToken
+	}
+	claims, err := cm.verifier.Verify(token)
+	if err != nil {
+		logger.Infof("auth: rejected upgrade from %s. Error: %v", r.RemoteAddr, err)
+		return nil, err
+	}
+
+	id := &identity{userId: claims.String(jwtCfg.UserClaim), remoteAddr: r.RemoteAddr, userAgent: r.UserAgent()}
+	if len(jwtCfg.Claims) > 0 {
+		id.claims = make(map[string]interface{}, len(jwtCfg.Claims))
+		for _, name := range jwtCfg.Claims {
+			if v, ok := claims[name]; ok {
+				id.claims[name] = v
+			}
+		}
+	}
+	if exp, ok := claims.ExpiresAt(); ok {
+		id.expiresAt = exp
+	}
+	id.bearer = fromProtocol
+	logger.Infof("auth: accepted upgrade from %s for userId: %s", r.RemoteAddr, id.userId)
+	return id, nil
+}
+
+// expireAt closes sess when the client's token expires.
+func (id *identity) expireAt(sess *Session) *time.Timer {
+	if id.expiresAt.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(id.expiresAt), func() {
+		logger.Infof("Token expired for sessionId: %s", sess.id)
+		sess.CloseWithReason(CloseTokenExpired, "token expired")
+	})
+}
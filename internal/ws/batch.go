@@ -0,0 +1,84 @@
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/jibitesh/request-response-manager/internal/logger"
+)
+
+type batchItem struct {
+	SessionId string `json:"sessionId"`
+	payload
+}
+
+type batchSendResult struct {
+	Results []DeliveryResult       `json:"results"`
+	Counts  map[DeliveryStatus]int `json:"counts"`
+}
+
+// Handles POST /send/batch with either {messages: [{sessionId, message|envelope}]}
+// or {sessionIds: [...], message|envelope} to send one message to many sessions.
+// Results follow the order of the recipients.
+func (cm *ConnectionManager) HandleSendBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Messages   []batchItem `json:"messages"`
+		SessionIds []string    `json:"sessionIds"`
+		payload
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if (len(req.Messages) == 0) == (len(req.SessionIds) == 0) {
+		http.Error(w, "Exactly one of messages or sessionIds is required", http.StatusBadRequest)
+		return
+	}
+	if n := len(req.Messages) + len(req.SessionIds); n > cm.cfg.Batch.MaxSize {
+		http.Error(w, fmt.Sprintf("Batch of %d exceeds the maximum of %d", n, cm.cfg.Batch.MaxSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var deliveries []delivery
+	if len(req.SessionIds) > 0 {
+		env, err := req.envelope()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		deliveries = make([]delivery, len(req.SessionIds))
+		for i, id := range req.SessionIds {
+			deliveries[i] = delivery{SessionId: id, Envelope: env}
+		}
+	} else {
+		deliveries = make([]delivery, len(req.Messages))
+		for i, item := range req.Messages {
+			env, err := item.envelope()
+			if err != nil {
+				http.Error(w, fmt.Sprintf("messages[%d]: %v", i, err), http.StatusBadRequest)
+				return
+			}
+			deliveries[i] = delivery{SessionId: item.SessionId, Envelope: env}
+		}
+	}
+
+	ids := make([]string, len(deliveries))
+	for i, d := range deliveries {
+		ids[i] = d.SessionId
+	}
+	infos, err := cm.sessionService.GetSessions(r.Context(), ids)
+	if err != nil {
+		logger.Errorf("Failed to look up %d sessions for batch send. Error: %v", len(ids), err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	results := cm.deliverAll(r.Context(), deliveries, infos)
+	countOut("send_batch", results...)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(batchSendResult{Results: results, Counts: countByStatus(results)})
+}
@@ -0,0 +1,41 @@
+package ws
+
+import (
+	"encoding/json"
+	"mime"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/jibitesh/request-response-manager/internal/message"
+)
+
+// binaryType returns contentType when it names binary data. JSON, text and
+// form bodies, and a missing content type, are text and yield "".
+func binaryType(contentType string) string {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	switch {
+	case mt == "application/json", strings.HasSuffix(mt, "+json"), strings.HasPrefix(mt, "text/"),
+		mt == "application/x-www-form-urlencoded", strings.HasPrefix(mt, "multipart/"):
+		return ""
+	}
+	return contentType
+}
+
+// frame renders env for sess. Binary messages go to websockets as binary
+// frames; the other transports only carry text and get the whole envelope,
+// with the payload base64-encoded.
+func (cm *ConnectionManager) frame(sess *Session, env *message.Envelope) (int, []byte, error) {
+	if !env.EncodesBinary(cm.cfg.Message.Format) {
+		data, err := env.Encode(cm.cfg.Message.Format)
+		return websocket.TextMessage, data, err
+	}
+	if sess.conn == nil {
+		data, err := json.Marshal(env)
+		return websocket.TextMessage, data, err
+	}
+	data, err := env.Encode(cm.cfg.Message.Format)
+	return websocket.BinaryMessage, data, err
+}
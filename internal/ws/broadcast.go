@@ -0,0 +1,231 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/jibitesh/request-response-manager/internal/logger"
+	"github.com/jibitesh/request-response-manager/internal/message"
+	"github.com/jibitesh/request-response-manager/internal/store"
+)
+
+// broadcastFilter selects the sessions a broadcast reaches. Every field that
+// is set must match; an empty filter matches every live connection.
+type broadcastFilter struct {
+	UserIds      []string `json:"userIds,omitempty"`
+	Subprotocols []string `json:"subprotocols,omitempty"`
+	// Claims match when the session's claim equals the value or, for list
+	// claims, contains it.
+	Claims map[string]string `json:"claims,omitempty"`
+}
+
+func (f *broadcastFilter) matches(sess *Session) bool {
+	if len(f.UserIds) > 0 && !contains(f.UserIds, sess.userId) {
+		return false
+	}
+	if len(f.Subprotocols) > 0 && !contains(f.Subprotocols, sess.subprotocol) {
+		return false
+	}
+	for name, want := range f.Claims {
+		switch v := sess.claims[name].(type) {
+		case []interface{}:
+			found := false
+			for _, item := range v {
+				if fmt.Sprint(item) == want {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		case nil:
+			return false
+		default:
+			if fmt.Sprint(v) != want {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+type broadcastRequest struct {
+	Filter   broadcastFilter   `json:"filter"`
+	Envelope *message.Envelope `json:"envelope"`
+}
+
+type instanceBroadcast struct {
+	Instance  string `json:"instance"`
+	Matched   int    `json:"matched"`
+	Delivered int    `json:"delivered"`
+	Failed    int    `json:"failed"`
+	Error     string `json:"error,omitempty"`
+}
+
+type broadcastResult struct {
+	MessageId string              `json:"messageId"`
+	Matched   int                 `json:"matched"`
+	Delivered int                 `json:"delivered"`
+	Failed    int                 `json:"failed"`
+	Instances []instanceBroadcast `json:"instances"`
+}
+
+// broadcastLocal writes env to every matching connection on this instance.
+// The frame is encoded and compressed once for all of them.
+func (cm *ConnectionManager) broadcastLocal(filter *broadcastFilter, env *message.Envelope) instanceBroadcast {
+	res := instanceBroadcast{Instance: cm.sessionService.Instance().Name}
+	frame, err := env.Encode(cm.cfg.Message.Format)
+	messageType, text := websocket.TextMessage, frame
+	if err == nil && env.EncodesBinary(cm.cfg.Message.Format) {
+		// Transports other than websocket get the whole envelope instead.
+		messageType = websocket.BinaryMessage
+		text, err = json.Marshal(env)
+	}
+	if err == nil {
+		var pm *websocket.PreparedMessage
+		if pm, err = websocket.NewPreparedMessage(messageType, frame); err == nil {
+			res.Matched, res.Delivered = cm.sendPrepared(filter, pm, text)
+			res.Failed = res.Matched - res.Delivered
+		}
+	}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
+
+func (cm *ConnectionManager) sendPrepared(filter *broadcastFilter, pm *websocket.PreparedMessage, frame []byte) (int, int) {
+	cm.connMu.RLock()
+	var targets []*Session
+	for _, sess := range cm.connections {
+		if filter.matches(sess) {
+			targets = append(targets, sess)
+		}
+	}
+	cm.connMu.RUnlock()
+
+	var delivered int
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, sess := range targets {
+		wg.Add(1)
+		go func(sess *Session) {
+			defer wg.Done()
+			if err := sess.SendPrepared(pm, frame); err != nil {
+				return
+			}
+			mu.Lock()
+			delivered++
+			mu.Unlock()
+		}(sess)
+	}
+	wg.Wait()
+	return len(targets), delivered
+}
+
+// Broadcast writes env to every live connection in the cluster that matches
+// filter, one request per peer instance, and reports the counts per instance.
+func (cm *ConnectionManager) Broadcast(ctx context.Context, registry store.InstanceRegistry, filter broadcastFilter, env *message.Envelope) (*broadcastResult, error) {
+	infos, err := registry.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	self := cm.sessionService.Instance()
+	results := make([]instanceBroadcast, 0, len(infos)+1)
+	results = append(results, cm.broadcastLocal(&filter, env))
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	req := broadcastRequest{Filter: filter, Envelope: env}
+	for _, info := range infos {
+		peer := info.Instance
+		if peer.Equal(self) {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := instanceBroadcast{Instance: peer.Name}
+			if _, err := cm.peers.Post(ctx, &peer, "/internal/broadcast", req, &res); err != nil {
+				logger.Errorf("Failed to forward broadcast: %s to %s. Error: %v", env.Id, peer.Addr(), err)
+				res = instanceBroadcast{Instance: peer.Name, Error: err.Error()}
+			}
+			mu.Lock()
+			results = append(results, res)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	out := &broadcastResult{MessageId: env.Id, Instances: results}
+	for _, res := range results {
+		out.Matched += res.Matched
+		out.Delivered += res.Delivered
+		out.Failed += res.Failed
+	}
+	return out, nil
+}
+
+// HandleBroadcast serves POST /broadcast {filter, message|envelope}, reaching
+// every live connection on every instance.
+func (cm *ConnectionManager) HandleBroadcast(registry store.InstanceRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			Filter broadcastFilter `json:"filter"`
+			payload
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		env, err := req.envelope()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		res, err := cm.Broadcast(r.Context(), registry, req.Filter, env)
+		if err != nil {
+			logger.Errorf("Failed to broadcast message: %s. Error: %v", env.Id, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		logger.Infof("Broadcast message: %s to %d of %d matching connections on %d instances", env.Id, res.Delivered, res.Matched, len(res.Instances))
+		countOutByStatus("broadcast", map[DeliveryStatus]int{StatusDelivered: res.Delivered, StatusFailed: res.Failed})
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
+
+// Handles POST /internal/broadcast {filter, envelope} from peer instances. Delivery is local only.
+func (cm *ConnectionManager) HandleInternalBroadcast(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req broadcastRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Envelope == nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(cm.broadcastLocal(&req.Filter, req.Envelope))
+}
@@ -3,81 +3,173 @@ package ws
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
-	"time"
+	"sync/atomic"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/jibitesh/request-response-manager/internal/auth"
+	"github.com/jibitesh/request-response-manager/internal/cluster"
+	"github.com/jibitesh/request-response-manager/internal/config"
 	"github.com/jibitesh/request-response-manager/internal/logger"
+	"github.com/jibitesh/request-response-manager/internal/message"
+	"github.com/jibitesh/request-response-manager/internal/metrics"
 	"github.com/jibitesh/request-response-manager/internal/store"
+	"github.com/jibitesh/request-response-manager/internal/upstream"
 )
 
 type ConnectionManager struct {
+	cfg            *config.Config
 	sessionService *store.SessionService
-	connections    map[string]*websocket.Conn
+	peers          *cluster.Client
+	dispatcher     *upstream.Dispatcher
+	verifier       *auth.Verifier
+	connections    map[string]*Session
 	connMu         sync.RWMutex
 	upgrader       websocket.Upgrader
-	pingFreq       time.Duration
 	closeOnce      sync.Once
+	draining       atomic.Bool
+	stop           chan struct{}
+	pending        *pendingRequests
+	acks           *ackTracker
+	callbacks      *http.Client
 }
 
-func NewConnectionManager(sessionService *store.SessionService) *ConnectionManager {
-	return &ConnectionManager{
+func NewConnectionManager(cfg *config.Config, sessionService *store.SessionService, peers *cluster.Client, dispatcher *upstream.Dispatcher, verifier *auth.Verifier) *ConnectionManager {
+	cm := &ConnectionManager{
+		cfg:            cfg,
 		sessionService: sessionService,
-		connections:    make(map[string]*websocket.Conn),
+		peers:          peers,
+		dispatcher:     dispatcher,
+		verifier:       verifier,
+		connections:    make(map[string]*Session),
 		upgrader: websocket.Upgrader{
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
-			CheckOrigin: func(r *http.Request) bool {
-				return true
-			},
 		},
-		pingFreq: 10 * time.Second,
+		pending: newPendingRequests(),
+		acks:    newAckTracker(),
+		// Redirects are not followed, or a checked callbackUrl could lead anywhere.
+		callbacks: &http.Client{
+			Timeout:       cfg.Ack.CallbackTimeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		stop: make(chan struct{}),
 	}
+	cm.upgrader.CheckOrigin = cm.checkOrigin
+	return cm
 }
 
-func (cm *ConnectionManager) HandleWSClient(w http.ResponseWriter, r *http.Request) {
-	conn, err := cm.upgrader.Upgrade(w, r, nil)
+// admit checks the origin and credentials of a client opening a connection,
+// and that this instance can take one more.
+func (cm *ConnectionManager) admit(w http.ResponseWriter, r *http.Request, transport string) (*identity, bool) {
+	if !cm.checkOrigin(r) {
+		metrics.UpgradeFailures.Inc(transport, "origin")
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil, false
+	}
+	if cm.Draining() {
+		metrics.UpgradeFailures.Inc(transport, "draining")
+		http.Error(w, "Instance is draining", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	if cm.AtCapacity() {
+		metrics.UpgradeFailures.Inc(transport, "capacity")
+		logger.Infof("Rejected %s connection from %s at the limit of %d connections", transport, r.RemoteAddr, cm.cfg.Connection.MaxConnections)
+		http.Error(w, "Connection limit reached", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	id, err := cm.authenticate(r)
 	if err != nil {
-		logger.Error("upgrade: %v", err)
-		http.Error(w, "Upgrade failed!", http.StatusBadRequest)
+		metrics.UpgradeFailures.Inc(transport, "unauthorized")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	return id, true
+}
+
+func (cm *ConnectionManager) HandleWSClient(w http.ResponseWriter, r *http.Request) {
+	id, ok := cm.admit(w, r, TransportWebSocket)
+	if !ok {
+		return
+	}
+	if !websocket.IsWebSocketUpgrade(r) {
+		metrics.UpgradeFailures.Inc(TransportWebSocket, "handshake")
+		http.Error(w, "Bad Request", http.StatusBadRequest)
 		return
 	}
 
-	sessionId := uuid.NewString()
-	cm.connMu.Lock()
-	cm.connections[sessionId] = conn
-	cm.connMu.Unlock()
+	// The session is opened before the handshake so its id and resume token
+	// can go in the handshake response.
+	ctx := context.Background()
+	header := cm.negotiateSubprotocol(r, id.bearer)
+	subprotocol := header.Get("Sec-Websocket-Protocol")
+	if subprotocol == auth.BearerProtocol {
+		subprotocol = ""
+	}
+	si, resumed, err := cm.openSession(ctx, resumeToken(r), &store.SessionInfo{
+		SessionId:   uuid.NewString(),
+		UserId:      id.userId,
+		Claims:      id.claims,
+		Subprotocol: subprotocol,
+	})
+	if err != nil {
+		metrics.UpgradeFailures.Inc(TransportWebSocket, "session")
+		logger.Errorf("set session: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	sessionId := si.SessionId
 
-	if _, err := cm.sessionService.AddSession(r.Context(), sessionId); err != nil {
-		logger.Error("set session: %v", err)
-		conn.Close()
-		cm.removeConnection(sessionId)
+	conn, err := cm.upgrader.Upgrade(w, r, sessionHeaders(header, si))
+	if err != nil {
+		metrics.UpgradeFailures.Inc(TransportWebSocket, "handshake")
+		logger.Errorf("upgrade: %v", err)
+		if err := cm.sessionService.ReleaseSession(ctx, sessionId, cm.cfg.Session.ResumeGrace); err != nil {
+			logger.Errorf("Failed to release session: %s with error: %v", sessionId, err)
+		}
 		return
 	}
+	sess := newWSSession(cm.cfg, sessionId, conn)
+	sess.identify(si)
+	sess.from(id)
+	defer sess.Close()
+	cm.armLiveness(sess)
+	if timer := id.expireAt(sess); timer != nil {
+		defer timer.Stop()
+	}
+	cm.addConnection(sessionId, sess)
+	go cm.keepAlive(sess)
+	cm.greet(ctx, si, resumed)
+
 	for {
-		messageType, message, err := conn.ReadMessage()
+		messageType, data, err := conn.ReadMessage()
 		if err != nil {
-			if websocket.IsCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				logger.Error("Connection closed normally for sessionId: %s. Error: %v", sessionId, err)
-			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				logger.Error("Connection closed abnormally for sessionId: %s. Error: %v", sessionId, err)
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				logger.Infof("Connection closed normally for sessionId: %s. Error: %v", sessionId, err)
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				logger.Errorf("Connection closed abnormally for sessionId: %s. Error: %v", sessionId, err)
 			} else {
-				logger.Error("Failed to read message from sessionId: %s. Error: %v", sessionId, err)
+				logger.Errorf("Failed to read message from sessionId: %s. Error: %v", sessionId, err)
 			}
-			if err := cm.sessionService.RemoveSession(r.Context(), sessionId); err != nil {
-				logger.Error("Failed to remove session: %s with error: %v", sessionId, err)
-				cm.removeConnection(sessionId)
+			if cm.removeConnection(sessionId, sess) {
+				if err := cm.sessionService.ReleaseSession(ctx, sessionId, cm.cfg.Session.ResumeGrace); err != nil {
+					logger.Errorf("Failed to release session: %s with error: %v", sessionId, err)
+				}
 			}
 			break
 		}
-		if messageType == websocket.TextMessage {
-			logger.Info("Received message from sessionId: %s. Message: %v", sessionId, message)
+		sess.received(len(data))
+		switch messageType {
+		case websocket.TextMessage:
+			cm.handleClientMessage(sess, data)
+		case websocket.BinaryMessage:
+			cm.handleClientBinary(sess, data, message.ContentTypeBinary)
 		}
 	}
 }
@@ -95,17 +187,20 @@ func (cm *ConnectionManager) HandleWSSend(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	// Binary frames are sent as this content type.
+	contentType := r.URL.Query().Get("contentType")
+
 	conn, err := cm.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		logger.Error("Failed to upgrade sessionId: %s to websocket. Error: %v", sessionId, err)
-		http.Error(w, "Failed to upgrade session to websocket.", http.StatusBadRequest)
+		// Upgrade has already answered the request with the error.
+		logger.Errorf("Failed to upgrade sessionId: %s to websocket. Error: %v", sessionId, err)
 		return
 	}
 	defer conn.Close()
-	logger.Info("Upgraded sessionId: %s to websocket.", sessionId)
+	logger.Infof("Upgraded sessionId: %s to websocket.", sessionId)
 
 	for {
-		messageType, message, err := conn.ReadMessage()
+		messageType, data, err := conn.ReadMessage()
 		if err != nil {
 			if websocket.IsCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				logger.Errorf("Connection closed normally for sessionId: %s. Error: %v", sessionId, err)
@@ -116,132 +211,198 @@ func (cm *ConnectionManager) HandleWSSend(w http.ResponseWriter, r *http.Request
 			}
 			break
 		}
-		logger.Info("Received message from sessionId: %s. Message: %s", sessionId, string(message))
-
-		if messageType == websocket.TextMessage {
-			cm.connMu.RLock()
-			conn, ok := cm.connections[sessionId]
-			cm.connMu.RUnlock()
-			if !ok || conn == nil {
-				http.Error(w, "WebSocket redirect: Session not connected to this instance.", http.StatusGone)
-				return
-			}
+		var env *message.Envelope
+		switch messageType {
+		case websocket.TextMessage:
+			logger.Info("Received message from sessionId: %s. Message: %s", sessionId, string(data))
+			env, err = toEnvelope(data)
+		case websocket.BinaryMessage:
+			logger.Infof("Received %d bytes of %s for sessionId: %s", len(data), contentType, sessionId)
+			env = message.NewBinary(data, contentType)
+		default:
+			continue
+		}
+		var res DeliveryResult
+		if err != nil {
+			res = DeliveryResult{SessionId: sessionId, Status: StatusFailed, Error: err.Error()}
+		} else {
+			res = cm.Deliver(r.Context(), sessionId, env)
+		}
+		countOut("ws_send", res)
+		if err := conn.WriteJSON(res); err != nil {
+			logger.Errorf("Failed to write delivery result for sessionId: %s. Error: %v", sessionId, err)
+			return
+		}
+	}
+}
 
-			if err := conn.WriteMessage(websocket.TextMessage, message); err != nil {
-				http.Error(w,
-					fmt.Sprintf("Failed to redirect websocket message to websocket of sessionid: %s.", sessionId),
-					http.StatusInternalServerError,
-				)
-				return
-			}
+type sendRequest struct {
+	SessionId    string `json:"sessionId"`
+	RequireAck   bool   `json:"requireAck"`
+	AckTimeoutMs int64  `json:"ackTimeoutMs"`
+	Wait         bool   `json:"wait"`
+	CallbackURL  string `json:"callbackUrl"`
+	Mailbox      bool   `json:"mailbox"`
+	MailboxTtlMs int64  `json:"mailboxTtlMs"`
+	payload
+}
 
-			_ = cm.sessionService.RefreshSession(r.Context(), sessionId)
-			w.WriteHeader(http.StatusOK)
-			_, _ = w.Write([]byte("OK"))
-			continue
+// readSendRequest decodes a JSON send request. Any other body is the data of
+// a binary message of its content type, and the other fields are given as
+// query parameters.
+func readSendRequest(r *http.Request) (*sendRequest, error) {
+	var req sendRequest
+	contentType := binaryType(r.Header.Get("Content-Type"))
+	if contentType == "" {
+		return &req, json.NewDecoder(r.Body).Decode(&req)
+	}
+
+	q := r.URL.Query()
+	req.SessionId = q.Get("sessionId")
+	req.CallbackURL = q.Get("callbackUrl")
+	for name, dst := range map[string]*bool{"requireAck": &req.RequireAck, "wait": &req.Wait, "mailbox": &req.Mailbox} {
+		if v := q.Get(name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %q", name, v)
+			}
+			*dst = b
+		}
+	}
+	for name, dst := range map[string]*int64{"ackTimeoutMs": &req.AckTimeoutMs, "mailboxTtlMs": &req.MailboxTtlMs} {
+		if v := q.Get(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %q", name, v)
+			}
+			*dst = n
 		}
 	}
-	return
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.Data, req.ContentType = data, contentType
+	return &req, nil
 }
 
-// Handles POST /send {session_id, message}
+// Handles POST /send {sessionId, message}, {sessionId, data, contentType} or
+// {sessionId, envelope}, or a binary body with ?sessionId=. With requireAck
+// the message is retransmitted until the client acks it; wait blocks for the
+// final status, callbackUrl receives it. With mailbox a message for a session
+// that is gone is kept until its client reclaims it.
 func (cm *ConnectionManager) HandleSend(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	var req struct {
-		SessionId string `json:"sessionId"`
-		Message   string `json:"message"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	req, err := readSendRequest(r)
+	if err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
 
-	// Ownership check
-	si, err := cm.sessionService.GetSession(r.Context(), req.SessionId)
-	if errors.Is(err, store.ErrNotFound) {
-		http.Error(w, "Session not found", http.StatusNotFound)
-		return
-	} else if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	if req.CallbackURL != "" && !cm.validCallback(req.CallbackURL) {
+		http.Error(w, "Invalid callbackUrl", http.StatusBadRequest)
 		return
 	}
-
-	if si.Instance.Name != cm.sessionService.Instance().Name {
-		http.Error(w, "Session owned by different instance.", http.StatusBadRequest)
+	env, err := req.envelope()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Send message to local connection
-	cm.connMu.RLock()
-	conn, ok := cm.connections[req.SessionId]
-	cm.connMu.RUnlock()
-	if !ok || conn == nil {
-		http.Error(w, "Session not connected to this instance.", http.StatusGone)
-		return
+	var res DeliveryResult
+	var done <-chan DeliveryResult
+	if req.RequireAck || env.Ack {
+		// The tracked message outlives this request, so it must not use its context.
+		res, done = cm.SendWithAck(context.Background(), req.SessionId, env, cm.ackTimeout(req.AckTimeoutMs), req.CallbackURL)
+	} else {
+		res = cm.Deliver(r.Context(), req.SessionId, env)
 	}
-
-	if err := conn.WriteMessage(websocket.TextMessage, []byte(req.Message)); err != nil {
-		http.Error(w, "Failed to write to websocket of sessionid.", http.StatusInternalServerError)
-		return
+	if res.Status == StatusSessionGone && req.Mailbox {
+		res = cm.mail(r.Context(), store.MailboxSession, req.SessionId, env, req.MailboxTtlMs)
+	}
+	if done != nil && req.Wait {
+		select {
+		case res = <-done:
+		case <-r.Context().Done():
+			return
+		}
 	}
+	countOut("send", res)
+	writeResult(w, res)
+}
 
-	_ = cm.sessionService.RefreshSession(r.Context(), req.SessionId)
-	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write([]byte("OK"))
+// Start runs the background session TTL refresh and ack retransmits until
+// CloseAllConnections.
+func (cm *ConnectionManager) Start() {
+	go cm.refreshLoop()
+	go cm.ackLoop()
 }
 
-func (cm *ConnectionManager) readLoop(sessionId string, conn *websocket.Conn) {
-	defer func() {
-		conn.Close()
-		cm.removeConnection(sessionId)
-		_ = cm.sessionService.RemoveSession(context.Background(), sessionId)
-		log.Println("Session s closed and Connection removed.", sessionId)
-	}()
+func (cm *ConnectionManager) ConnectionCount() int {
+	cm.connMu.RLock()
+	defer cm.connMu.RUnlock()
+	return len(cm.connections)
+}
 
-	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
-	for {
-		_, _, err := conn.ReadMessage()
-		if err != nil {
-			log.Println("Read error:", err)
-			return
-		}
-		_ = cm.sessionService.RefreshSession(context.Background(), sessionId)
-		err = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
-	}
+// AtCapacity reports whether the instance holds as many connections as it may.
+func (cm *ConnectionManager) AtCapacity() bool {
+	max := cm.cfg.Connection.MaxConnections
+	return max > 0 && cm.ConnectionCount() >= max
 }
 
-func (cm *ConnectionManager) pinger(sessionId string, conn *websocket.Conn) {
-	ticker := time.NewTicker(cm.pingFreq)
-	defer ticker.Stop()
+// BeginDrain marks the instance as draining, so it reports itself not ready
+// and turns away new connections.
+func (cm *ConnectionManager) BeginDrain() {
+	cm.draining.Store(true)
+}
 
-	for range ticker.C {
-		if err := conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(5*time.Second)); err != nil {
-			return
-		}
+func (cm *ConnectionManager) Draining() bool {
+	return cm.draining.Load()
+}
+
+func (cm *ConnectionManager) session(sessionId string) *Session {
+	cm.connMu.RLock()
+	defer cm.connMu.RUnlock()
+	return cm.connections[sessionId]
+}
+
+// addConnection registers sess for sessionId, closing any session it
+// replaces when a client resumes on the instance that still holds it.
+func (cm *ConnectionManager) addConnection(sessionId string, sess *Session) {
+	cm.connMu.Lock()
+	old := cm.connections[sessionId]
+	cm.connections[sessionId] = sess
+	cm.connMu.Unlock()
+	if old != nil && old != sess {
+		old.Close()
 	}
 }
 
-func (cm *ConnectionManager) removeConnection(sessionId string) {
+// removeConnection unregisters sess and reports whether it was still the
+// session's current connection.
+func (cm *ConnectionManager) removeConnection(sessionId string, sess *Session) bool {
 	cm.connMu.Lock()
 	defer cm.connMu.Unlock()
+	if cm.connections[sessionId] != sess {
+		return false
+	}
 	delete(cm.connections, sessionId)
+	return true
 }
 
 func (cm *ConnectionManager) CloseAllConnections() error {
-	var firstError error
 	cm.closeOnce.Do(func() {
+		close(cm.stop)
 		cm.connMu.Lock()
 		defer cm.connMu.Unlock()
-		for sid, conn := range cm.connections {
-			if err := conn.Close(); err != nil && firstError == nil {
-				firstError = err
-			}
-			_ = cm.sessionService.RemoveSession(context.Background(), sid)
+		for sid, sess := range cm.connections {
+			sess.Close()
+			_ = cm.sessionService.ReleaseSession(context.Background(), sid, cm.cfg.Session.ResumeGrace)
 		}
-		cm.connections = make(map[string]*websocket.Conn)
+		cm.connections = make(map[string]*Session)
 	})
-	return firstError
+	return nil
 }
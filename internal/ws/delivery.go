@@ -0,0 +1,180 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/jibitesh/request-response-manager/internal/cluster"
+	"github.com/jibitesh/request-response-manager/internal/logger"
+	"github.com/jibitesh/request-response-manager/internal/message"
+	"github.com/jibitesh/request-response-manager/internal/store"
+	"github.com/jibitesh/request-response-manager/pkg/instance"
+)
+
+type DeliveryStatus string
+
+const (
+	StatusDelivered        DeliveryStatus = "delivered"
+	StatusBuffered         DeliveryStatus = "buffered"
+	StatusSessionGone      DeliveryStatus = "session_gone"
+	StatusOwnerUnreachable DeliveryStatus = "owner_unreachable"
+	StatusTimeout          DeliveryStatus = "timeout"
+	StatusFailed           DeliveryStatus = "failed"
+	StatusPending          DeliveryStatus = "pending"
+	StatusAcked            DeliveryStatus = "acked"
+	StatusExpired          DeliveryStatus = "expired"
+	StatusMailboxed        DeliveryStatus = "mailboxed"
+)
+
+func (s DeliveryStatus) HTTPStatus() int {
+	switch s {
+	case StatusDelivered, StatusAcked:
+		return http.StatusOK
+	case StatusBuffered, StatusPending, StatusMailboxed:
+		return http.StatusAccepted
+	case StatusSessionGone:
+		return http.StatusGone
+	case StatusOwnerUnreachable:
+		return http.StatusBadGateway
+	case StatusTimeout, StatusExpired:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+type DeliveryResult struct {
+	SessionId string         `json:"sessionId"`
+	MessageId string         `json:"messageId,omitempty"`
+	Status    DeliveryStatus `json:"status"`
+	Error     string         `json:"error,omitempty"`
+}
+
+// payload is the message part of service requests: a legacy text message,
+// base64-encoded binary data, or a full envelope. ContentType describes the
+// message or data.
+type payload struct {
+	Message     string            `json:"message"`
+	Data        []byte            `json:"data"`
+	ContentType string            `json:"contentType"`
+	Envelope    *message.Envelope `json:"envelope"`
+}
+
+func (p payload) envelope() (*message.Envelope, error) {
+	switch {
+	case p.Envelope != nil:
+		if err := p.Envelope.Normalize(); err != nil {
+			return nil, err
+		}
+		return p.Envelope, nil
+	case p.Data != nil:
+		return message.NewBinary(p.Data, p.ContentType), nil
+	}
+	env := message.FromText(p.Message)
+	if p.ContentType != "" {
+		env.SetContentType(p.ContentType)
+	}
+	return env, nil
+}
+
+type deliverRequest struct {
+	SessionId string            `json:"sessionId"`
+	Envelope  *message.Envelope `json:"envelope"`
+}
+
+// Deliver writes env to the session's client, forwarding it to the owning
+// instance when the session is connected elsewhere in the cluster.
+func (cm *ConnectionManager) Deliver(ctx context.Context, sessionId string, env *message.Envelope) DeliveryResult {
+	si, err := cm.sessionService.GetSession(ctx, sessionId)
+	if errors.Is(err, store.ErrNotFound) {
+		return DeliveryResult{SessionId: sessionId, MessageId: env.Id, Status: StatusSessionGone}
+	} else if err != nil {
+		logger.Errorf("Failed to look up sessionId: %s. Error: %v", sessionId, err)
+		return DeliveryResult{SessionId: sessionId, MessageId: env.Id, Status: StatusFailed, Error: err.Error()}
+	}
+
+	if si.Detached() {
+		return cm.buffer(ctx, sessionId, env)
+	}
+	if si.Instance.Equal(cm.sessionService.Instance()) {
+		return cm.deliverLocal(ctx, sessionId, env)
+	}
+	return cm.forward(ctx, si.Instance, sessionId, env)
+}
+
+func (cm *ConnectionManager) deliverLocal(ctx context.Context, sessionId string, env *message.Envelope) DeliveryResult {
+	res := cm.writeLocal(sessionId, env)
+	if res.Status == StatusDelivered {
+		_ = cm.sessionService.RefreshSession(ctx, sessionId)
+	}
+	return res
+}
+
+// writeLocal writes env to a session connected to this instance without
+// refreshing the session's TTL.
+func (cm *ConnectionManager) writeLocal(sessionId string, env *message.Envelope) DeliveryResult {
+	sess := cm.session(sessionId)
+	if sess == nil {
+		return DeliveryResult{SessionId: sessionId, MessageId: env.Id, Status: StatusSessionGone}
+	}
+
+	messageType, frame, err := cm.frame(sess, env)
+	if err != nil {
+		return DeliveryResult{SessionId: sessionId, MessageId: env.Id, Status: StatusFailed, Error: err.Error()}
+	}
+	if err := sess.Send(messageType, frame); errors.Is(err, ErrSessionClosed) {
+		return DeliveryResult{SessionId: sessionId, MessageId: env.Id, Status: StatusSessionGone}
+	} else if err != nil {
+		logger.Errorf("Failed to send to sessionId: %s. Error: %v", sessionId, err)
+		return DeliveryResult{SessionId: sessionId, MessageId: env.Id, Status: StatusFailed, Error: err.Error()}
+	}
+	return DeliveryResult{SessionId: sessionId, MessageId: env.Id, Status: StatusDelivered}
+}
+
+func (cm *ConnectionManager) forward(ctx context.Context, owner *instance.Instance, sessionId string, env *message.Envelope) DeliveryResult {
+	var res DeliveryResult
+	req := deliverRequest{SessionId: sessionId, Envelope: env}
+	if _, err := cm.peers.Post(ctx, owner, "/internal/deliver", req, &res); err != nil {
+		logger.Errorf("Failed to forward message for sessionId: %s to %s. Error: %v", sessionId, owner.Addr(), err)
+		if errors.Is(err, cluster.ErrUnreachable) {
+			return DeliveryResult{SessionId: sessionId, MessageId: env.Id, Status: StatusOwnerUnreachable, Error: err.Error()}
+		}
+		return DeliveryResult{SessionId: sessionId, MessageId: env.Id, Status: StatusFailed, Error: err.Error()}
+	}
+	return res
+}
+
+// Handles POST /internal/deliver {sessionId, envelope} from peer instances. Delivery is local only.
+func (cm *ConnectionManager) HandleInternalDeliver(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req deliverRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Envelope == nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	writeResult(w, cm.deliverLocal(r.Context(), req.SessionId, req.Envelope))
+}
+
+// toEnvelope turns a frame sent by a service into an envelope. Envelopes pass
+// through as they are; anything else is wrapped as a plain message.
+func toEnvelope(frame []byte) (*message.Envelope, error) {
+	env, err := message.Parse(frame)
+	if !errors.Is(err, message.ErrNotEnvelope) {
+		return env, err
+	}
+	if json.Valid(frame) {
+		return message.New(message.TypeMessage, frame), nil
+	}
+	return message.FromText(string(frame)), nil
+}
+
+func writeResult(w http.ResponseWriter, res DeliveryResult) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(res.Status.HTTPStatus())
+	_ = json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,91 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/jibitesh/request-response-manager/internal/logger"
+)
+
+// CloseReconnect is sent to clients of a draining instance. The reason
+// carries "retryAfterMs=<n>", how long the client should wait before
+// reconnecting, which then lands it on another instance.
+const CloseReconnect = 4002
+
+// Drain turns away new connections, then flushes each client's outbound
+// queue and asks it to reconnect elsewhere. It returns once every client has
+// left, or at the drain timeout or ctx deadline with the rest still connected
+// for CloseAllConnections to close.
+func (cm *ConnectionManager) Drain(ctx context.Context) {
+	cm.BeginDrain()
+	ctx, cancel := context.WithTimeout(ctx, cm.cfg.Drain.Timeout)
+	defer cancel()
+
+	// Connections admitted just before the drain began may register later,
+	// so every round asks the ones not asked yet.
+	asked := make(map[*Session]bool)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		cm.connMu.RLock()
+		var fresh []*Session
+		for _, sess := range cm.connections {
+			if !asked[sess] {
+				asked[sess] = true
+				fresh = append(fresh, sess)
+			}
+		}
+		n := len(cm.connections)
+		cm.connMu.RUnlock()
+		if n == 0 {
+			logger.Infof("Drained all connections")
+			return
+		}
+		if len(fresh) > 0 {
+			logger.Infof("Draining %d connections", len(fresh))
+		}
+		for _, sess := range fresh {
+			go func(sess *Session) {
+				reason := fmt.Sprintf("reconnect elsewhere; retryAfterMs=%d", cm.reconnectDelay().Milliseconds())
+				if err := sess.CloseAfterFlush(CloseReconnect, reason); err != nil && !errors.Is(err, ErrSessionClosed) {
+					logger.Infof("Failed to close draining sessionId: %s. Error: %v", sess.id, err)
+				}
+			}(sess)
+		}
+		select {
+		case <-ctx.Done():
+			logger.Infof("Drain deadline reached with %d connections left", n)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CloseReaped closes every connection once the cluster has reaped this
+// instance's sessions for missed heartbeats. Clients reconnect and reclaim
+// their sessions, which the reaper retains for their mail.
+func (cm *ConnectionManager) CloseReaped() {
+	cm.connMu.RLock()
+	sessions := make([]*Session, 0, len(cm.connections))
+	for _, sess := range cm.connections {
+		sessions = append(sessions, sess)
+	}
+	cm.connMu.RUnlock()
+	logger.Infof("Closing %d connections of reaped sessions", len(sessions))
+	for _, sess := range sessions {
+		reason := fmt.Sprintf("session lost; retryAfterMs=%d", cm.reconnectDelay().Milliseconds())
+		go sess.CloseWithReason(CloseReconnect, reason)
+	}
+}
+
+// reconnectDelay spreads the reconnects of drained clients over the jitter.
+func (cm *ConnectionManager) reconnectDelay() time.Duration {
+	delay := cm.cfg.Drain.ReconnectDelay
+	if jitter := cm.cfg.Drain.ReconnectJitter; jitter > 0 {
+		delay += rand.N(jitter)
+	}
+	return delay
+}
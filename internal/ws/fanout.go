@@ -0,0 +1,180 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/jibitesh/request-response-manager/internal/cluster"
+	"github.com/jibitesh/request-response-manager/internal/logger"
+	"github.com/jibitesh/request-response-manager/internal/message"
+	"github.com/jibitesh/request-response-manager/internal/store"
+	"github.com/jibitesh/request-response-manager/pkg/instance"
+)
+
+type delivery struct {
+	SessionId string            `json:"sessionId"`
+	Envelope  *message.Envelope `json:"envelope"`
+}
+
+type batchDeliverRequest struct {
+	Deliveries []delivery `json:"deliveries"`
+}
+
+// deliverAll delivers each envelope to its session given the sessions' already
+// resolved infos. Local sessions are written concurrently and each remote owner
+// gets a single batched request. Results follow the order of deliveries.
+func (cm *ConnectionManager) deliverAll(ctx context.Context, deliveries []delivery, infos map[string]*store.SessionInfo) []DeliveryResult {
+	results := make([]DeliveryResult, len(deliveries))
+	var local []int
+	remote := make(map[string][]int)
+	owners := make(map[string]*instance.Instance)
+
+	for i, d := range deliveries {
+		si, ok := infos[d.SessionId]
+		switch {
+		case !ok:
+			results[i] = DeliveryResult{SessionId: d.SessionId, MessageId: d.Envelope.Id, Status: StatusSessionGone}
+		case si.Detached():
+			results[i] = cm.buffer(ctx, d.SessionId, d.Envelope)
+		case si.Instance.Equal(cm.sessionService.Instance()):
+			local = append(local, i)
+		default:
+			remote[si.Instance.Name] = append(remote[si.Instance.Name], i)
+			owners[si.Instance.Name] = si.Instance
+		}
+	}
+
+	var wg sync.WaitGroup
+	for name, idxs := range remote {
+		wg.Add(1)
+		go func(owner *instance.Instance, idxs []int) {
+			defer wg.Done()
+			cm.forwardAll(ctx, owner, deliveries, idxs, results)
+		}(owners[name], idxs)
+	}
+	cm.writeAll(ctx, deliveries, local, results)
+	wg.Wait()
+	return results
+}
+
+// writeAll writes the deliveries at idxs to local sessions. Sessions are
+// written concurrently, each one's messages in order, and the TTLs of the
+// sessions written to are refreshed in one round trip.
+func (cm *ConnectionManager) writeAll(ctx context.Context, deliveries []delivery, idxs []int, results []DeliveryResult) {
+	bySession := make(map[string][]int)
+	for _, i := range idxs {
+		id := deliveries[i].SessionId
+		bySession[id] = append(bySession[id], i)
+	}
+
+	var wg sync.WaitGroup
+	for _, idxs := range bySession {
+		wg.Add(1)
+		go func(idxs []int) {
+			defer wg.Done()
+			for _, i := range idxs {
+				results[i] = cm.writeLocal(deliveries[i].SessionId, deliveries[i].Envelope)
+			}
+		}(idxs)
+	}
+	wg.Wait()
+
+	var written []string
+	for id, idxs := range bySession {
+		for _, i := range idxs {
+			if results[i].Status == StatusDelivered {
+				written = append(written, id)
+				break
+			}
+		}
+	}
+	if err := cm.sessionService.RefreshSessions(ctx, written); err != nil {
+		logger.Errorf("Failed to refresh %d sessions after batch delivery. Error: %v", len(written), err)
+	}
+}
+
+// fanOut delivers env to every session in sessionIds and also returns the ids
+// of sessions that no longer exist, so callers can prune their indexes.
+func (cm *ConnectionManager) fanOut(ctx context.Context, sessionIds []string, env *message.Envelope) ([]DeliveryResult, []string, error) {
+	infos, err := cm.sessionService.GetSessions(ctx, sessionIds)
+	if err != nil {
+		return nil, nil, err
+	}
+	var stale []string
+	deliveries := make([]delivery, 0, len(sessionIds))
+	for _, id := range sessionIds {
+		if _, ok := infos[id]; !ok {
+			stale = append(stale, id)
+			continue
+		}
+		deliveries = append(deliveries, delivery{SessionId: id, Envelope: env})
+	}
+	return cm.deliverAll(ctx, deliveries, infos), stale, nil
+}
+
+func (cm *ConnectionManager) forwardAll(ctx context.Context, owner *instance.Instance, deliveries []delivery, idxs []int, results []DeliveryResult) {
+	req := batchDeliverRequest{Deliveries: make([]delivery, len(idxs))}
+	for j, i := range idxs {
+		req.Deliveries[j] = deliveries[i]
+	}
+
+	var res []DeliveryResult
+	_, err := cm.peers.Post(ctx, owner, "/internal/deliver/batch", req, &res)
+	if err == nil && len(res) != len(idxs) {
+		err = fmt.Errorf("cluster: %s answered %d results for %d deliveries", owner.Addr(), len(res), len(idxs))
+	}
+	if err != nil {
+		logger.Errorf("Failed to forward %d deliveries to %s. Error: %v", len(idxs), owner.Addr(), err)
+		status := StatusFailed
+		if errors.Is(err, cluster.ErrUnreachable) {
+			status = StatusOwnerUnreachable
+		}
+		for _, i := range idxs {
+			d := deliveries[i]
+			results[i] = DeliveryResult{SessionId: d.SessionId, MessageId: d.Envelope.Id, Status: status, Error: err.Error()}
+		}
+		return
+	}
+	for j, i := range idxs {
+		results[i] = res[j]
+	}
+}
+
+// Handles POST /internal/deliver/batch {deliveries} from peer instances. Delivery is local only.
+func (cm *ConnectionManager) HandleInternalDeliverBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req batchDeliverRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	results := make([]DeliveryResult, len(req.Deliveries))
+	var idxs []int
+	for i, d := range req.Deliveries {
+		if d.Envelope == nil {
+			results[i] = DeliveryResult{SessionId: d.SessionId, Status: StatusFailed, Error: "missing envelope"}
+			continue
+		}
+		idxs = append(idxs, i)
+	}
+	cm.writeAll(r.Context(), req.Deliveries, idxs, results)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(results)
+}
+
+func countByStatus(results []DeliveryResult) map[DeliveryStatus]int {
+	counts := make(map[DeliveryStatus]int)
+	for _, res := range results {
+		counts[res.Status]++
+	}
+	return counts
+}
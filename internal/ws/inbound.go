@@ -0,0 +1,128 @@
+package ws
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jibitesh/request-response-manager/internal/logger"
+	"github.com/jibitesh/request-response-manager/internal/message"
+	"github.com/jibitesh/request-response-manager/internal/upstream"
+)
+
+// inbound is a client message waiting to be dispatched upstream.
+type inbound struct {
+	frame       []byte
+	contentType string
+}
+
+func (cm *ConnectionManager) handleClientMessage(sess *Session, frame []byte) {
+	sessionId := sess.id
+	env, err := message.Parse(frame)
+	if errors.Is(err, message.ErrUnsupportedVersion) {
+		logger.Infof("Dropping envelope with unsupported version from sessionId: %s", sessionId)
+		cm.countIn(sessionId, inUnsupported)
+		return
+	}
+	if env != nil && env.Type == message.TypeResponse && env.CorrelationId != "" {
+		if !cm.pending.resolve(sessionId, env.CorrelationId, env.Payload) {
+			logger.Infof("Dropping reply with unknown correlationId: %s from sessionId: %s", env.CorrelationId, sessionId)
+		}
+		cm.countIn(sessionId, inResponse)
+		return
+	}
+	if env != nil && env.Type == message.TypeAck && env.CorrelationId != "" {
+		cm.handleAck(sessionId, env.CorrelationId)
+		cm.countIn(sessionId, inAck)
+		return
+	}
+	if env != nil && (env.Type == message.TypeSubscribe || env.Type == message.TypeUnsubscribe) {
+		cm.handleSubscription(sessionId, env)
+		cm.countIn(sessionId, inSubscription)
+		return
+	}
+
+	if !cm.dispatcher.Enabled() {
+		logger.Infof("Received message from sessionId: %s. Message: %s", sessionId, string(frame))
+		cm.countIn(sessionId, inIgnored)
+		return
+	}
+	cm.enqueueUpstream(sess, &inbound{frame: frame})
+}
+
+// handleClientBinary passes binary data from a client upstream as it is.
+func (cm *ConnectionManager) handleClientBinary(sess *Session, data []byte, contentType string) {
+	if !cm.dispatcher.Enabled() {
+		logger.Infof("Received %d bytes of %s from sessionId: %s", len(data), contentType, sess.id)
+		cm.countIn(sess.id, inIgnored)
+		return
+	}
+	cm.enqueueUpstream(sess, &inbound{frame: data, contentType: contentType})
+}
+
+// enqueueUpstream queues a client message for the session's dispatcher,
+// starting it on first use. A client that outpaces upstream has its messages
+// dropped once the queue is full, rather than holding up its connection.
+func (cm *ConnectionManager) enqueueUpstream(sess *Session, in *inbound) {
+	sess.upstreamOnce.Do(func() { go cm.upstreamLoop(sess) })
+	select {
+	case sess.upstream <- in:
+	default:
+		logger.Infof("Upstream queue full for sessionId: %s. Message dropped.", sess.id)
+		cm.countIn(sess.id, inDropped)
+	}
+}
+
+// upstreamLoop dispatches a session's messages one at a time, retries
+// included, so upstream sees them in order. Messages still queued when the
+// session closes are dispatched before it returns.
+func (cm *ConnectionManager) upstreamLoop(sess *Session) {
+	for {
+		select {
+		case in := <-sess.upstream:
+			cm.dispatchUpstream(sess.id, in.frame, in.contentType)
+		case <-sess.closed:
+			for {
+				select {
+				case in := <-sess.upstream:
+					cm.dispatchUpstream(sess.id, in.frame, in.contentType)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (cm *ConnectionManager) dispatchUpstream(sessionId string, frame []byte, contentType string) {
+	res, err := cm.dispatcher.Dispatch(context.Background(), sessionId, frame, contentType)
+	if errors.Is(err, upstream.ErrNoRoute) {
+		logger.Infof("No upstream route for message from sessionId: %s. Message dropped.", sessionId)
+		cm.countIn(sessionId, inNoRoute)
+		return
+	} else if err != nil {
+		logger.Errorf("Failed to dispatch message from sessionId: %s upstream. Error: %v", sessionId, err)
+		cm.countIn(sessionId, inFailed)
+		return
+	}
+	cm.countIn(sessionId, inDispatched)
+	if len(res.Reply) == 0 {
+		return
+	}
+	env, err := replyEnvelope(res.Reply, res.ContentType)
+	if err != nil {
+		logger.Errorf("Invalid upstream %s reply for sessionId: %s. Error: %v", res.Route, sessionId, err)
+		return
+	}
+	if out := cm.deliverLocal(context.Background(), sessionId, env); out.Status != StatusDelivered {
+		logger.Errorf("Failed to write upstream %s reply to sessionId: %s. Status: %s", res.Route, sessionId, out.Status)
+	}
+}
+
+// replyEnvelope turns an upstream reply into an envelope for the client,
+// keeping binary replies binary.
+func replyEnvelope(reply []byte, contentType string) (*message.Envelope, error) {
+	if ct := binaryType(contentType); ct != "" {
+		return message.NewBinary(reply, ct), nil
+	}
+	return toEnvelope(reply)
+}
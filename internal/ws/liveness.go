@@ -0,0 +1,94 @@
+package ws
+
+import (
+	"context"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/jibitesh/request-response-manager/internal/logger"
+)
+
+// armLiveness makes reads on sess fail once the client misses a pong. Every
+// pong pushes the read deadline out again.
+func (cm *ConnectionManager) armLiveness(sess *Session) {
+	deadline := cm.cfg.Connection.PingInterval + cm.cfg.Connection.PongTimeout
+	_ = sess.conn.SetReadDeadline(time.Now().Add(deadline))
+	sess.conn.SetPongHandler(func(string) error {
+		return sess.conn.SetReadDeadline(time.Now().Add(deadline))
+	})
+}
+
+// keepAlive pings the client and closes sessions that stay idle past the idle
+// timeout. Closing the connection ends the read loop, which cleans up.
+func (cm *ConnectionManager) keepAlive(sess *Session) {
+	ticker := time.NewTicker(cm.cfg.Connection.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			deadline := time.Now().Add(cm.cfg.Connection.PongTimeout)
+			if err := sess.conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				logger.Infof("Ping failed for sessionId: %s. Error: %v", sess.id, err)
+				sess.Close()
+				return
+			}
+			if idle := cm.cfg.Connection.IdleTimeout; idle > 0 && time.Since(sess.LastActivity()) > idle {
+				logger.Infof("Closing idle sessionId: %s", sess.id)
+				sess.CloseWithReason(websocket.CloseGoingAway, "idle timeout")
+				return
+			}
+		case <-sess.closed:
+			return
+		}
+	}
+}
+
+// refreshLoop extends the Redis TTL of every locally connected session, its
+// subscriptions and its user's session index.
+func (cm *ConnectionManager) refreshLoop() {
+	ticker := time.NewTicker(cm.cfg.Connection.TTLRefresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ids := cm.sessionIds()
+			ctx, cancel := context.WithTimeout(context.Background(), cm.cfg.Connection.TTLRefresh)
+			if err := cm.sessionService.RefreshSessions(ctx, ids); err != nil {
+				logger.Errorf("Failed to refresh %d session ttls. Error: %v", len(ids), err)
+			}
+			if err := cm.sessionService.RefreshIndexes(ctx, ids, cm.userIds()); err != nil {
+				logger.Errorf("Failed to refresh session indexes. Error: %v", err)
+			}
+			cancel()
+		case <-cm.stop:
+			return
+		}
+	}
+}
+
+func (cm *ConnectionManager) sessionIds() []string {
+	cm.connMu.RLock()
+	defer cm.connMu.RUnlock()
+	ids := make([]string, 0, len(cm.connections))
+	for id := range cm.connections {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// userIds returns the distinct users of the locally connected sessions.
+func (cm *ConnectionManager) userIds() []string {
+	cm.connMu.RLock()
+	defer cm.connMu.RUnlock()
+	seen := make(map[string]bool)
+	var ids []string
+	for _, sess := range cm.connections {
+		if sess.userId != "" && !seen[sess.userId] {
+			seen[sess.userId] = true
+			ids = append(ids, sess.userId)
+		}
+	}
+	return ids
+}
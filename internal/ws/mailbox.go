@@ -0,0 +1,187 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jibitesh/request-response-manager/internal/logger"
+	"github.com/jibitesh/request-response-manager/internal/message"
+	"github.com/jibitesh/request-response-manager/internal/store"
+)
+
+type mailEntry struct {
+	Id        string            `json:"id"`
+	ExpiresAt time.Time         `json:"expiresAt"`
+	Envelope  *message.Envelope `json:"envelope"`
+}
+
+type mailboxResult struct {
+	Kind     string      `json:"kind"`
+	Id       string      `json:"id"`
+	Size     int64       `json:"size"`
+	Messages []mailEntry `json:"messages"`
+}
+
+// mail keeps env in the mailbox of a session or user that is offline.
+func (cm *ConnectionManager) mail(ctx context.Context, kind, id string, env *message.Envelope, ttlMs int64) DeliveryResult {
+	res := DeliveryResult{SessionId: id, MessageId: env.Id, Status: StatusSessionGone}
+	if !cm.sessionService.MailboxEnabled() {
+		return res
+	}
+	frame, err := json.Marshal(env)
+	if err == nil {
+		_, err = cm.sessionService.PushMail(ctx, kind, id, frame, cm.mailTTL(ttlMs))
+	}
+	if err != nil {
+		logger.Errorf("Failed to put message: %s in mailbox of %s: %s. Error: %v", env.Id, kind, id, err)
+		res.Status, res.Error = StatusFailed, err.Error()
+		return res
+	}
+	res.Status = StatusMailboxed
+	return res
+}
+
+// mailTTL returns the requested mail TTL, bounded by the configured maximum.
+func (cm *ConnectionManager) mailTTL(ms int64) time.Duration {
+	if ms <= 0 {
+		return cm.cfg.Mailbox.TTL
+	}
+	ttl := time.Duration(ms) * time.Millisecond
+	if max := cm.cfg.Mailbox.MaxTTL; max > 0 && ttl > max {
+		return max
+	}
+	return ttl
+}
+
+// drainMail writes the mail kept for the session and then its user, oldest
+// first. Mail the client did not take is put back.
+func (cm *ConnectionManager) drainMail(ctx context.Context, si *store.SessionInfo) {
+	if !cm.sessionService.MailboxEnabled() {
+		return
+	}
+	boxes := [][2]string{{store.MailboxSession, si.SessionId}}
+	if si.UserId != "" {
+		boxes = append(boxes, [2]string{store.MailboxUser, si.UserId})
+	}
+	for _, box := range boxes {
+		kind, id := box[0], box[1]
+		entries, err := cm.sessionService.DrainMail(ctx, kind, id)
+		if err != nil {
+			logger.Errorf("Failed to drain mailbox of %s: %s. Error: %v", kind, id, err)
+			return
+		}
+		for i, entry := range entries {
+			var env message.Envelope
+			if err := json.Unmarshal(entry.Frame, &env); err != nil {
+				continue
+			}
+			if res := cm.deliverLocal(ctx, si.SessionId, &env); res.Status != StatusDelivered {
+				logger.Errorf("Failed to deliver mail: %s to sessionId: %s. Status: %s", env.Id, si.SessionId, res.Status)
+				cm.restoreMail(ctx, kind, id, entries[i:])
+				return
+			}
+		}
+		if len(entries) > 0 {
+			logger.Infof("Delivered %d messages from mailbox of %s: %s to sessionId: %s", len(entries), kind, id, si.SessionId)
+		}
+	}
+}
+
+func (cm *ConnectionManager) restoreMail(ctx context.Context, kind, id string, entries []store.MailEntry) {
+	for _, entry := range entries {
+		ttl := time.Until(entry.ExpiresAt)
+		if ttl <= 0 {
+			continue
+		}
+		if _, err := cm.sessionService.PushMail(ctx, kind, id, entry.Frame, ttl); err != nil {
+			logger.Errorf("Failed to restore mail to mailbox of %s: %s. Error: %v", kind, id, err)
+			return
+		}
+	}
+}
+
+// mailboxPath parses /mailbox/{session|user}/{id}.
+func mailboxPath(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	if !strings.HasPrefix(r.URL.Path, "/mailbox/") {
+		http.Error(w, "Invalid mailbox path format", http.StatusBadRequest)
+		return "", "", false
+	}
+	kind, id, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/mailbox/"), "/")
+	if (kind != store.MailboxSession && kind != store.MailboxUser) || id == "" {
+		http.Error(w, "Invalid mailbox path format", http.StatusBadRequest)
+		return "", "", false
+	}
+	return kind, id, true
+}
+
+// Handles GET /mailbox/{session|user}/{id}?limit=n, listing the oldest unexpired mail.
+func (cm *ConnectionManager) HandleMailboxList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !cm.sessionService.MailboxEnabled() {
+		http.Error(w, "Mailbox disabled", http.StatusNotFound)
+		return
+	}
+	kind, id, ok := mailboxPath(w, r)
+	if !ok {
+		return
+	}
+	limit := int64(100)
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	entries, size, err := cm.sessionService.ListMail(r.Context(), kind, id, limit)
+	if err != nil {
+		logger.Errorf("Failed to list mailbox of %s: %s. Error: %v", kind, id, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	res := mailboxResult{Kind: kind, Id: id, Size: size, Messages: make([]mailEntry, 0, len(entries))}
+	for _, entry := range entries {
+		var env message.Envelope
+		if err := json.Unmarshal(entry.Frame, &env); err != nil {
+			continue
+		}
+		res.Messages = append(res.Messages, mailEntry{Id: entry.Id, ExpiresAt: entry.ExpiresAt, Envelope: &env})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// Handles DELETE /mailbox/{session|user}/{id}[?entryId=...], purging the given
+// entries or the whole mailbox.
+func (cm *ConnectionManager) HandleMailboxPurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !cm.sessionService.MailboxEnabled() {
+		http.Error(w, "Mailbox disabled", http.StatusNotFound)
+		return
+	}
+	kind, id, ok := mailboxPath(w, r)
+	if !ok {
+		return
+	}
+	purged, err := cm.sessionService.PurgeMail(r.Context(), kind, id, r.URL.Query()["entryId"]...)
+	if err != nil {
+		logger.Errorf("Failed to purge mailbox of %s: %s. Error: %v", kind, id, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	logger.Infof("Purged %d messages from mailbox of %s: %s", purged, kind, id)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int64{"purged": purged})
+}
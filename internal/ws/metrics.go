@@ -0,0 +1,52 @@
+package ws
+
+import (
+	"github.com/jibitesh/request-response-manager/internal/metrics"
+)
+
+// What became of a message from a client.
+const (
+	inResponse     = "response"
+	inAck          = "ack"
+	inSubscription = "subscription"
+	inDispatched   = "dispatched"
+	inNoRoute      = "no_route"
+	inFailed       = "failed"
+	inDropped      = "dropped"
+	inIgnored      = "ignored"
+	inUnsupported  = "unsupported"
+)
+
+// countOut records the results of a service send to endpoint.
+func countOut(endpoint string, results ...DeliveryResult) {
+	for _, res := range results {
+		metrics.Messages.Inc(metrics.Out, endpoint, string(res.Status))
+	}
+}
+
+func countOutByStatus(endpoint string, counts map[DeliveryStatus]int) {
+	for status, n := range counts {
+		metrics.Messages.Add(float64(n), metrics.Out, endpoint, string(status))
+	}
+}
+
+// countIn records a message from the client of sessionId under the
+// session's transport.
+func (cm *ConnectionManager) countIn(sessionId, result string) {
+	transport := "unknown"
+	if sess := cm.session(sessionId); sess != nil {
+		transport = sess.Transport()
+	}
+	metrics.Messages.Inc(metrics.In, transport, result)
+}
+
+// ConnectionsByTransport counts the connections held by this instance.
+func (cm *ConnectionManager) ConnectionsByTransport() map[string]float64 {
+	counts := map[string]float64{TransportWebSocket: 0, TransportSSE: 0, TransportPoll: 0}
+	cm.connMu.RLock()
+	defer cm.connMu.RUnlock()
+	for _, sess := range cm.connections {
+		counts[sess.Transport()]++
+	}
+	return counts
+}
@@ -0,0 +1,111 @@
+package ws
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/jibitesh/request-response-manager/internal/auth"
+	"github.com/jibitesh/request-response-manager/internal/logger"
+)
+
+// checkOrigin accepts requests without an Origin header, which come from
+// non-browser clients, and requests whose origin matches the allow-list.
+// Without an allow-list only same-host origins are accepted.
+func (cm *ConnectionManager) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		logger.Infof("Rejected upgrade from %s with malformed origin: %s", r.RemoteAddr, origin)
+		return false
+	}
+	allowed := cm.cfg.Connection.AllowedOrigins
+	if len(allowed) == 0 {
+		return strings.EqualFold(u.Host, r.Host)
+	}
+	for _, pattern := range allowed {
+		if matchOrigin(pattern, u) {
+			return true
+		}
+	}
+	logger.Infof("Rejected upgrade from %s with disallowed origin: %s", r.RemoteAddr, origin)
+	return false
+}
+
+// allowOrigin lets a browser client read the response to a request whose
+// origin passed checkOrigin.
+func allowOrigin(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		w.Header().Add("Vary", "Origin")
+	}
+}
+
+// matchOrigin matches origin against "*", "host[:port]" or
+// "scheme://host[:port]", where host may start with "*." to match any
+// subdomain and an IPv6 host is bracketed when a port follows. A pattern
+// without a port, or with port "*", matches any port.
+func matchOrigin(pattern string, origin *url.URL) bool {
+	if pattern == "*" {
+		return true
+	}
+	if scheme, rest, ok := strings.Cut(pattern, "://"); ok {
+		if !strings.EqualFold(scheme, origin.Scheme) {
+			return false
+		}
+		pattern = rest
+	}
+	host, port, err := net.SplitHostPort(pattern)
+	if err != nil {
+		// No port, possibly a bare or bracketed IPv6 address.
+		host, port = strings.TrimSuffix(strings.TrimPrefix(pattern, "["), "]"), ""
+	}
+	if port != "" && port != "*" && port != originPort(origin) {
+		return false
+	}
+	originHost := strings.ToLower(origin.Hostname())
+	host = strings.ToLower(host)
+	if suffix, ok := strings.CutPrefix(host, "*."); ok {
+		return strings.HasSuffix(originHost, "."+suffix)
+	}
+	return originHost == host
+}
+
+// originPort is the origin's port, or its scheme's default when it has none.
+func originPort(origin *url.URL) string {
+	if port := origin.Port(); port != "" {
+		return port
+	}
+	switch strings.ToLower(origin.Scheme) {
+	case "https", "wss":
+		return "443"
+	case "http", "ws":
+		return "80"
+	}
+	return ""
+}
+
+// negotiateSubprotocol picks the first configured subprotocol the client
+// offered. When the client authenticated through Sec-WebSocket-Protocol and
+// offered none of them, the bearer marker is echoed back instead, since
+// browsers fail the handshake when the server selects nothing.
+func (cm *ConnectionManager) negotiateSubprotocol(r *http.Request, bearer bool) http.Header {
+	offered := websocket.Subprotocols(r)
+	for _, supported := range cm.cfg.Connection.Subprotocols {
+		for _, p := range offered {
+			if p == supported {
+				return http.Header{"Sec-Websocket-Protocol": {p}}
+			}
+		}
+	}
+	if bearer {
+		return http.Header{"Sec-Websocket-Protocol": {auth.BearerProtocol}}
+	}
+	return nil
+}
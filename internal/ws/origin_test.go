@@ -0,0 +1,117 @@
+package ws
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/jibitesh/request-response-manager/internal/config"
+	"github.com/jibitesh/request-response-manager/internal/logger"
+)
+
+func TestMain(m *testing.M) {
+	config.AppConfig = &config.Config{}
+	config.AppConfig.Logger.Level = "fatal"
+	if err := logger.Init(); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+func TestMatchOrigin(t *testing.T) {
+	tests := []struct {
+		pattern string
+		origin  string
+		want    bool
+	}{
+		{"*", "https://anything.example", true},
+
+		{"example.com", "https://example.com", true},
+		{"example.com", "http://example.com:8080", true},
+		{"example.com", "https://EXAMPLE.com", true},
+		{"example.com", "https://app.example.com", false},
+		{"example.com", "https://example.com.evil.net", false},
+
+		{"*.example.com", "https://app.example.com", true},
+		{"*.example.com", "https://a.b.example.com:8443", true},
+		{"*.example.com", "https://example.com", false},
+		{"*.example.com", "https://badexample.com", false},
+		{"*.example.com", "https://example.com.evil.net", false},
+
+		{"example.com:8080", "http://example.com:8080", true},
+		{"example.com:8080", "http://example.com:9090", false},
+		{"example.com:8080", "http://example.com", false},
+		{"example.com:443", "https://example.com", true},
+		{"example.com:80", "http://example.com", true},
+		{"example.com:80", "https://example.com", false},
+		{"example.com:*", "http://example.com:1234", true},
+		{"*.example.com:8443", "https://app.example.com:8443", true},
+		{"*.example.com:8443", "https://app.example.com", false},
+
+		{"https://example.com", "https://example.com", true},
+		{"https://example.com", "http://example.com", false},
+		{"https://example.com:8443", "https://example.com:8443", true},
+		{"https://example.com:8443", "https://example.com:443", false},
+		{"https://*.example.com", "https://app.example.com", true},
+		{"https://*.example.com", "http://app.example.com", false},
+
+		{"[::1]:8080", "http://[::1]:8080", true},
+		{"[::1]:8080", "http://[::1]:9090", false},
+		{"[::1]", "http://[::1]:9090", true},
+		{"::1", "http://[::1]:9090", true},
+		{"::1", "http://[::2]:9090", false},
+		{"http://[2001:db8::1]:3000", "http://[2001:db8::1]:3000", true},
+		{"http://[2001:db8::1]:3000", "http://[2001:db8::2]:3000", false},
+		{"[2001:db8::1]", "https://[2001:DB8::1]", true},
+
+		{"127.0.0.1:3000", "http://127.0.0.1:3000", true},
+		{"127.0.0.1", "http://127.0.0.2", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.origin, func(t *testing.T) {
+			origin, err := url.Parse(tt.origin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := matchOrigin(tt.pattern, origin); got != tt.want {
+				t.Errorf("matchOrigin(%q, %q) = %v, want %v", tt.pattern, tt.origin, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		host    string
+		origin  string
+		want    bool
+	}{
+		{"no origin header", []string{"example.com"}, "rrm.local", "", true},
+		{"same host without allow-list", nil, "rrm.local:8080", "http://rrm.local:8080", true},
+		{"other host without allow-list", nil, "rrm.local:8080", "http://evil.net", false},
+		{"same host with another port", nil, "rrm.local:8080", "http://rrm.local:9090", false},
+		{"allow-listed", []string{"*.example.com", "localhost:3000"}, "rrm.local", "http://localhost:3000", true},
+		{"not allow-listed", []string{"*.example.com", "localhost:3000"}, "rrm.local", "http://localhost:4000", false},
+		{"allow-list replaces same host", []string{"example.com"}, "rrm.local", "http://rrm.local", false},
+		{"malformed origin", []string{"*"}, "rrm.local", "http://[::1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config.Config
+			cfg.Connection.AllowedOrigins = tt.allowed
+			cm := &ConnectionManager{cfg: &cfg}
+			r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+			r.Host = tt.host
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if got := cm.checkOrigin(r); got != tt.want {
+				t.Errorf("checkOrigin() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
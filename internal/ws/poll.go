@@ -0,0 +1,553 @@
+package ws
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/jibitesh/request-response-manager/internal/logger"
+	"github.com/jibitesh/request-response-manager/internal/message"
+	"github.com/jibitesh/request-response-manager/internal/metrics"
+	"github.com/jibitesh/request-response-manager/internal/store"
+	"github.com/jibitesh/request-response-manager/pkg/instance"
+)
+
+var errNotPolled = errors.New("ws: client did not poll before the write deadline")
+
+type pollClose struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// pollTransport holds a session's frames until its client polls for them.
+// A full buffer blocks writers like a slow socket would, so a client that
+// stops polling hits the write timeout and the session is closed.
+//
+// The last batch handed out stays pending until the next poll confirms it by
+// sending back the batch's cursor, or sends no cursor at all. A poll with an
+// older cursor gets the pending batch again, as does the poll after one that
+// was aborted before its batch could be written.
+type pollTransport struct {
+	frames   chan []byte
+	done     chan struct{}
+	mu       sync.Mutex
+	closing  *pollClose
+	pending  [][]byte
+	cursor   uint64
+	sent     bool
+	polls    atomic.Int32
+	lastPoll atomic.Int64
+}
+
+func newPollTransport(size int) *pollTransport {
+	t := &pollTransport{
+		frames: make(chan []byte, size),
+		done:   make(chan struct{}),
+	}
+	t.lastPoll.Store(time.Now().UnixNano())
+	return t
+}
+
+func (t *pollTransport) name() string {
+	return TransportPoll
+}
+
+func (t *pollTransport) write(out *outbound, deadline time.Time) error {
+	if out.messageType == websocket.PingMessage {
+		return nil
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case t.frames <- out.data:
+		return nil
+	case <-t.done:
+		return ErrSessionClosed
+	case <-timer.C:
+		return errNotPolled
+	}
+}
+
+// writeClose records why the session closed for the next poll to report.
+func (t *pollTransport) writeClose(code int, reason string, deadline time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closing = &pollClose{Code: code, Reason: reason}
+	return nil
+}
+
+func (t *pollTransport) close() error {
+	close(t.done)
+	return nil
+}
+
+// poll confirms the batch named by cursor, "" confirming whatever was sent
+// last, and returns the pending batch if it was not confirmed. Otherwise it
+// waits up to wait for a frame and returns it with whatever else is queued,
+// at most max frames. The batch is returned with its cursor and kept until
+// confirmed. Once the session is closed and every frame has been taken it
+// also reports how the session was closed.
+func (t *pollTransport) poll(ctx context.Context, wait time.Duration, max int, cursor string) ([][]byte, uint64, *pollClose) {
+	t.polls.Add(1)
+	t.lastPoll.Store(time.Now().UnixNano())
+	defer func() {
+		t.lastPoll.Store(time.Now().UnixNano())
+		t.polls.Add(-1)
+	}()
+
+	t.mu.Lock()
+	if t.sent && (cursor == "" || cursor == strconv.FormatUint(t.cursor, 10)) {
+		t.pending = nil
+	}
+	if ctx.Err() != nil {
+		defer t.mu.Unlock()
+		return nil, t.cursor, nil
+	}
+	if len(t.pending) > 0 {
+		frames := t.pending
+		t.cursor++
+		t.sent = true
+		next, closed := t.cursor, t.closed()
+		t.mu.Unlock()
+		return frames, next, closed
+	}
+	t.mu.Unlock()
+
+	var frames [][]byte
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case frame := <-t.frames:
+		frames = append(frames, frame)
+	case <-t.done:
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+	// An aborted poll has nobody to write to, so what it took waits for the
+	// next one.
+	if ctx.Err() == nil {
+	drain:
+		for len(frames) < max {
+			select {
+			case frame := <-t.frames:
+				frames = append(frames, frame)
+			default:
+				break drain
+			}
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending = append(t.pending, frames...)
+	if ctx.Err() != nil {
+		t.sent = false
+		return nil, t.cursor, nil
+	}
+	t.cursor++
+	t.sent = len(t.pending) > 0
+	return t.pending, t.cursor, t.closed()
+}
+
+// closed is called with t.mu held.
+func (t *pollTransport) closed() *pollClose {
+	select {
+	case <-t.done:
+	default:
+		return nil
+	}
+	if len(t.frames) > 0 {
+		return nil
+	}
+	if t.closing == nil {
+		return &pollClose{Code: websocket.CloseGoingAway, Reason: "session closed"}
+	}
+	return t.closing
+}
+
+// idleFor is how long nobody has been polling.
+func (t *pollTransport) idleFor() time.Duration {
+	if t.polls.Load() > 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, t.lastPoll.Load()))
+}
+
+// unpolled empties the buffer once the session is closed, starting with the
+// batch no poll confirmed.
+func (t *pollTransport) unpolled() [][]byte {
+	t.mu.Lock()
+	frames := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+	for {
+		select {
+		case frame := <-t.frames:
+			frames = append(frames, frame)
+		default:
+			return frames
+		}
+	}
+}
+
+type pollRequest struct {
+	SessionId string `json:"sessionId"`
+	WaitMs    int64  `json:"waitMs,omitempty"`
+	Cursor    string `json:"cursor,omitempty"`
+	Frame     []byte `json:"frame,omitempty"`
+	// ContentType is set for binary frames.
+	ContentType string `json:"contentType,omitempty"`
+}
+
+type pollResult struct {
+	SessionId string            `json:"sessionId"`
+	Messages  []json.RawMessage `json:"messages"`
+	// Cursor names this batch; the next poll sends it back to confirm it.
+	Cursor uint64     `json:"cursor"`
+	Closed *pollClose `json:"closed,omitempty"`
+}
+
+// startPoll registers a poll session for si on this instance.
+func (cm *ConnectionManager) startPoll(si *store.SessionInfo, resumed bool, id *identity) {
+	t := newPollTransport(cm.cfg.Connection.QueueSize)
+	sess := newSession(cm.cfg, si.SessionId, t)
+	sess.identify(si)
+	sess.from(id)
+	cm.addConnection(si.SessionId, sess)
+	go cm.watchPoll(sess, t, id.expireAt(sess))
+	// The client only starts polling once it has the session id, so the
+	// greeting must not wait for a poll.
+	go cm.greet(context.Background(), si, resumed)
+}
+
+// watchPoll closes sess once its client stops polling and then detaches the
+// session, so it can be resumed like a dropped websocket. Frames no poll
+// took are buffered for the resume.
+func (cm *ConnectionManager) watchPoll(sess *Session, t *pollTransport, expiry *time.Timer) {
+	if expiry != nil {
+		defer expiry.Stop()
+	}
+	var tick <-chan time.Time
+	idle := cm.cfg.Poll.IdleTimeout
+	if idle > 0 {
+		ticker := time.NewTicker(idle / 2)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+watch:
+	for {
+		select {
+		case <-tick:
+			if t.idleFor() > idle {
+				logger.Infof("Closing poll sessionId: %s that stopped polling", sess.id)
+				sess.Close()
+				break watch
+			}
+		case <-sess.closed:
+			break watch
+		}
+	}
+	<-sess.stopped
+
+	ctx := context.Background()
+	if !cm.removeConnection(sess.id, sess) {
+		return
+	}
+	if cm.cfg.Session.ResumeGrace > 0 {
+		for _, frame := range t.unpolled() {
+			if env, err := message.Parse(frame); err == nil {
+				cm.buffer(ctx, sess.id, env)
+			}
+		}
+	}
+	if err := cm.sessionService.ReleaseSession(ctx, sess.id, cm.cfg.Session.ResumeGrace); err != nil {
+		logger.Errorf("Failed to release session: %s with error: %v", sess.id, err)
+	}
+}
+
+// HandlePollOpen serves POST /poll, opening a long-polling session for
+// clients that can use neither websockets nor SSE. Like a websocket upgrade it
+// resumes the session named by a resume token.
+func (cm *ConnectionManager) HandlePollOpen(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, ok := cm.admit(w, r, TransportPoll)
+	if !ok {
+		return
+	}
+
+	si, resumed, err := cm.openSession(context.Background(), resumeToken(r), &store.SessionInfo{
+		SessionId: uuid.NewString(),
+		UserId:    id.userId,
+		Claims:    id.claims,
+	})
+	if err != nil {
+		metrics.UpgradeFailures.Inc(TransportPoll, "session")
+		logger.Errorf("set session: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	cm.startPoll(si, resumed, id)
+	logger.Infof("Opened poll sessionId: %s", si.SessionId)
+
+	allowOrigin(w, r)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(sessionPayload{
+		SessionId:   si.SessionId,
+		ResumeToken: si.ResumeToken,
+		Resumed:     resumed,
+		GraceMs:     cm.cfg.Session.ResumeGrace.Milliseconds(),
+	})
+}
+
+// HandlePoll serves GET /poll/{id}?timeoutMs=n&cursor=c, waiting for messages
+// for the session wherever in the cluster it is held. The cursor of the last
+// batch received confirms it; without one a failed response loses its batch. A session detached because its
+// client stopped polling is resumed here; the client then finds its next
+// resume token in the session message.
+func (cm *ConnectionManager) HandlePoll(w http.ResponseWriter, r *http.Request) {
+	if !cm.checkOrigin(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	si, ok := cm.pollSession(w, r)
+	if !ok {
+		return
+	}
+	if si.Detached() {
+		if si, ok = cm.resumePoll(w, r); !ok {
+			return
+		}
+	}
+
+	wait := cm.pollWait(r.URL.Query().Get("timeoutMs"))
+	cursor := r.URL.Query().Get("cursor")
+	var res *pollResult
+	var status int
+	if si.Instance.Equal(cm.sessionService.Instance()) {
+		res, status = cm.pollLocal(r.Context(), si.SessionId, wait, cursor)
+	} else {
+		res, status = cm.forwardPoll(r.Context(), si.Instance, wait, pollRequest{SessionId: si.SessionId, WaitMs: wait.Milliseconds(), Cursor: cursor})
+	}
+	allowOrigin(w, r)
+	writePoll(w, res, status)
+}
+
+// HandlePollSend serves POST /poll/{id}, taking the body as one message from
+// the session's client. A body that is not JSON or text is binary data.
+func (cm *ConnectionManager) HandlePollSend(w http.ResponseWriter, r *http.Request) {
+	if !cm.checkOrigin(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	si, ok := cm.pollSession(w, r)
+	if !ok {
+		return
+	}
+	frame, err := io.ReadAll(http.MaxBytesReader(w, r.Body, cm.cfg.Poll.MaxFrameSize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "Message too large", http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if si.Detached() {
+		http.Error(w, "Session detached, poll to resume it", http.StatusConflict)
+		return
+	}
+	contentType := binaryType(r.Header.Get("Content-Type"))
+
+	var status int
+	if si.Instance.Equal(cm.sessionService.Instance()) {
+		status = cm.pollSendLocal(si.SessionId, frame, contentType)
+	} else {
+		status = cm.forwardPollSend(r.Context(), si.Instance, pollRequest{SessionId: si.SessionId, Frame: frame, ContentType: contentType})
+	}
+	allowOrigin(w, r)
+	if status != http.StatusAccepted {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	w.WriteHeader(status)
+}
+
+// pollSession resolves /poll/{id} to its session, checking that the request
+// carries the session's current resume token.
+func (cm *ConnectionManager) pollSession(w http.ResponseWriter, r *http.Request) (*store.SessionInfo, bool) {
+	sessionId := strings.TrimPrefix(r.URL.Path, "/poll/")
+	if sessionId == "" || strings.Contains(sessionId, "/") {
+		http.Error(w, "Invalid poll path format", http.StatusBadRequest)
+		return nil, false
+	}
+	si, err := cm.sessionService.GetSession(r.Context(), sessionId)
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "Session gone", http.StatusGone)
+		return nil, false
+	} else if err != nil {
+		logger.Errorf("Failed to look up sessionId: %s. Error: %v", sessionId, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil, false
+	}
+	token := resumeToken(r)
+	if token == "" || subtle.ConstantTimeCompare([]byte(si.ResumeToken), []byte(token)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	return si, true
+}
+
+// resumePoll takes over a detached poll session. It opens a connection on
+// this instance, so it is admitted like a new one, and like any resume it
+// needs the client to authenticate as the session's user.
+func (cm *ConnectionManager) resumePoll(w http.ResponseWriter, r *http.Request) (*store.SessionInfo, bool) {
+	id, ok := cm.admit(w, r, TransportPoll)
+	if !ok {
+		return nil, false
+	}
+	si, superseded, err := cm.sessionService.ResumeSession(context.Background(), resumeToken(r), &store.SessionInfo{
+		UserId: id.userId,
+		Claims: id.claims,
+	})
+	if errors.Is(err, store.ErrInvalidResumeToken) {
+		http.Error(w, "Session gone", http.StatusGone)
+		return nil, false
+	} else if err != nil {
+		logger.Errorf("Failed to resume poll session. Error: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil, false
+	}
+	cm.supersede(context.Background(), si.SessionId, superseded)
+	cm.startPoll(si, true, id)
+	logger.Infof("Resumed poll sessionId: %s", si.SessionId)
+	return si, true
+}
+
+// pollWait returns the requested poll timeout, bounded by the configured maximum.
+func (cm *ConnectionManager) pollWait(ms string) time.Duration {
+	n, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil || n < 0 {
+		return cm.cfg.Poll.Timeout
+	}
+	wait := time.Duration(n) * time.Millisecond
+	if max := cm.cfg.Poll.MaxTimeout; max > 0 && wait > max {
+		return max
+	}
+	return wait
+}
+
+func (cm *ConnectionManager) pollLocal(ctx context.Context, sessionId string, wait time.Duration, cursor string) (*pollResult, int) {
+	sess := cm.session(sessionId)
+	if sess == nil {
+		return nil, http.StatusGone
+	}
+	t, ok := sess.transport.(*pollTransport)
+	if !ok {
+		return nil, http.StatusConflict
+	}
+	frames, next, closed := t.poll(ctx, wait, cm.cfg.Poll.MaxBatch, cursor)
+	res := &pollResult{SessionId: sessionId, Messages: make([]json.RawMessage, 0, len(frames)), Cursor: next, Closed: closed}
+	for _, frame := range frames {
+		if !json.Valid(frame) {
+			frame, _ = json.Marshal(string(frame))
+		}
+		res.Messages = append(res.Messages, frame)
+	}
+	return res, http.StatusOK
+}
+
+func (cm *ConnectionManager) pollSendLocal(sessionId string, frame []byte, contentType string) int {
+	sess := cm.session(sessionId)
+	if sess == nil {
+		return http.StatusGone
+	}
+	if _, ok := sess.transport.(*pollTransport); !ok {
+		return http.StatusConflict
+	}
+	sess.received(len(frame))
+	if contentType != "" {
+		cm.handleClientBinary(sess, frame, contentType)
+	} else {
+		cm.handleClientMessage(sess, frame)
+	}
+	return http.StatusAccepted
+}
+
+func (cm *ConnectionManager) forwardPoll(ctx context.Context, owner *instance.Instance, wait time.Duration, req pollRequest) (*pollResult, int) {
+	ctx, cancel := context.WithTimeout(ctx, wait+cm.cfg.Cluster.ForwardTimeout)
+	defer cancel()
+	var res pollResult
+	status, err := cm.peers.Post(ctx, owner, "/internal/poll", req, &res)
+	if status != 0 && status != http.StatusOK {
+		return nil, status
+	}
+	if err != nil {
+		logger.Errorf("Failed to forward poll for sessionId: %s to %s. Error: %v", req.SessionId, owner.Addr(), err)
+		return nil, http.StatusBadGateway
+	}
+	return &res, http.StatusOK
+}
+
+func (cm *ConnectionManager) forwardPollSend(ctx context.Context, owner *instance.Instance, req pollRequest) int {
+	status, err := cm.peers.Post(ctx, owner, "/internal/poll/send", req, nil)
+	if err != nil {
+		logger.Errorf("Failed to forward message from poll sessionId: %s to %s. Error: %v", req.SessionId, owner.Addr(), err)
+		return http.StatusBadGateway
+	}
+	return status
+}
+
+// Handles POST /internal/poll {sessionId, waitMs} from peer instances. Polls local sessions only.
+func (cm *ConnectionManager) HandleInternalPoll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req pollRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	res, status := cm.pollLocal(r.Context(), req.SessionId, time.Duration(req.WaitMs)*time.Millisecond, req.Cursor)
+	writePoll(w, res, status)
+}
+
+// Handles POST /internal/poll/send {sessionId, frame} from peer instances, for local sessions only.
+func (cm *ConnectionManager) HandleInternalPollSend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req pollRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if status := cm.pollSendLocal(req.SessionId, req.Frame, req.ContentType); status != http.StatusAccepted {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func writePoll(w http.ResponseWriter, res *pollResult, status int) {
+	if res == nil {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
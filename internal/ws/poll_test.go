@@ -0,0 +1,93 @@
+package ws
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func queued(t *pollTransport, frames ...string) {
+	for _, f := range frames {
+		t.frames <- []byte(f)
+	}
+}
+
+func batch(frames [][]byte) []string {
+	out := make([]string, len(frames))
+	for i, f := range frames {
+		out[i] = string(f)
+	}
+	return out
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPollAbortedTakesNothing(t *testing.T) {
+	tr := newPollTransport(8)
+	queued(tr, "a", "b")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if frames, _, _ := tr.poll(ctx, time.Second, 10, ""); len(frames) != 0 {
+		t.Fatalf("aborted poll returned %v", batch(frames))
+	}
+	frames, _, _ := tr.poll(context.Background(), time.Second, 10, "")
+	if got := batch(frames); !equal(got, []string{"a", "b"}) {
+		t.Fatalf("poll after abort = %v, want [a b]", got)
+	}
+}
+
+func TestPollRedeliversUnconfirmedBatch(t *testing.T) {
+	tr := newPollTransport(8)
+	queued(tr, "a")
+	frames, cursor, _ := tr.poll(context.Background(), time.Second, 10, "0")
+	if got := batch(frames); !equal(got, []string{"a"}) {
+		t.Fatalf("first poll = %v, want [a]", got)
+	}
+
+	// The response was lost, so the client polls with its previous cursor.
+	queued(tr, "b")
+	frames, next, _ := tr.poll(context.Background(), time.Second, 10, "0")
+	if got := batch(frames); !equal(got, []string{"a"}) {
+		t.Fatalf("poll with stale cursor = %v, want [a]", got)
+	}
+	if next == cursor {
+		t.Fatalf("redelivered batch kept cursor %d", next)
+	}
+
+	frames, _, _ = tr.poll(context.Background(), time.Second, 10, strconv.FormatUint(next, 10))
+	if got := batch(frames); !equal(got, []string{"b"}) {
+		t.Fatalf("poll after confirming = %v, want [b]", got)
+	}
+}
+
+func TestPollWithoutCursorConfirms(t *testing.T) {
+	tr := newPollTransport(8)
+	queued(tr, "a")
+	tr.poll(context.Background(), time.Second, 10, "")
+	queued(tr, "b")
+	frames, _, _ := tr.poll(context.Background(), time.Second, 10, "")
+	if got := batch(frames); !equal(got, []string{"b"}) {
+		t.Fatalf("second poll = %v, want [b]", got)
+	}
+}
+
+func TestUnpolledIncludesPendingBatch(t *testing.T) {
+	tr := newPollTransport(8)
+	queued(tr, "a")
+	tr.poll(context.Background(), time.Second, 10, "")
+	queued(tr, "b")
+	if got := batch(tr.unpolled()); !equal(got, []string{"a", "b"}) {
+		t.Fatalf("unpolled = %v, want [a b]", got)
+	}
+}
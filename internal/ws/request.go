@@ -0,0 +1,185 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jibitesh/request-response-manager/internal/cluster"
+	"github.com/jibitesh/request-response-manager/internal/logger"
+	"github.com/jibitesh/request-response-manager/internal/message"
+	"github.com/jibitesh/request-response-manager/internal/store"
+	"github.com/jibitesh/request-response-manager/pkg/instance"
+)
+
+type requestRequest struct {
+	SessionId string            `json:"sessionId"`
+	Message   json.RawMessage   `json:"message"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	TimeoutMs int64             `json:"timeoutMs,omitempty"`
+}
+
+type requestResult struct {
+	DeliveryResult
+	Reply json.RawMessage `json:"reply,omitempty"`
+}
+
+type pendingRequest struct {
+	sessionId string
+	reply     chan json.RawMessage
+}
+
+// pendingRequests tracks requests pushed to local clients that are waiting for a reply.
+type pendingRequests struct {
+	mu      sync.Mutex
+	waiters map[string]*pendingRequest
+}
+
+func newPendingRequests() *pendingRequests {
+	return &pendingRequests{waiters: make(map[string]*pendingRequest)}
+}
+
+func (p *pendingRequests) add(sessionId, correlationId string) chan json.RawMessage {
+	pr := &pendingRequest{sessionId: sessionId, reply: make(chan json.RawMessage, 1)}
+	p.mu.Lock()
+	p.waiters[correlationId] = pr
+	p.mu.Unlock()
+	return pr.reply
+}
+
+func (p *pendingRequests) remove(correlationId string) {
+	p.mu.Lock()
+	delete(p.waiters, correlationId)
+	p.mu.Unlock()
+}
+
+// resolve hands payload to the waiter of correlationId. Replies from a session
+// other than the one the request was sent to are ignored.
+func (p *pendingRequests) resolve(sessionId, correlationId string, payload json.RawMessage) bool {
+	p.mu.Lock()
+	pr, ok := p.waiters[correlationId]
+	if ok && pr.sessionId == sessionId {
+		delete(p.waiters, correlationId)
+	}
+	p.mu.Unlock()
+	if !ok || pr.sessionId != sessionId {
+		return false
+	}
+	pr.reply <- payload
+	return true
+}
+
+// Request pushes a request envelope to the session's client and waits up to
+// timeout for a response envelope whose correlationId is the request's id.
+func (cm *ConnectionManager) Request(ctx context.Context, req requestRequest, timeout time.Duration) requestResult {
+	sessionId := req.SessionId
+	si, err := cm.sessionService.GetSession(ctx, sessionId)
+	if errors.Is(err, store.ErrNotFound) {
+		return requestResult{DeliveryResult: DeliveryResult{SessionId: sessionId, Status: StatusSessionGone}}
+	} else if err != nil {
+		logger.Errorf("Failed to look up sessionId: %s. Error: %v", sessionId, err)
+		return requestResult{DeliveryResult: DeliveryResult{SessionId: sessionId, Status: StatusFailed, Error: err.Error()}}
+	}
+
+	if si.Instance.Equal(cm.sessionService.Instance()) {
+		return cm.requestLocal(ctx, req, timeout)
+	}
+	return cm.forwardRequest(ctx, si.Instance, req, timeout)
+}
+
+func (cm *ConnectionManager) requestLocal(ctx context.Context, req requestRequest, timeout time.Duration) requestResult {
+	sessionId := req.SessionId
+	env := message.New(message.TypeRequest, req.Message)
+	env.Headers = req.Headers
+	reply := cm.pending.add(sessionId, env.Id)
+	defer cm.pending.remove(env.Id)
+
+	res := cm.deliverLocal(ctx, sessionId, env)
+	if res.Status != StatusDelivered {
+		return requestResult{DeliveryResult: res}
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case payload := <-reply:
+		return requestResult{DeliveryResult: res, Reply: payload}
+	case <-timer.C:
+		return requestResult{DeliveryResult: DeliveryResult{SessionId: sessionId, MessageId: env.Id, Status: StatusTimeout}}
+	case <-ctx.Done():
+		return requestResult{DeliveryResult: DeliveryResult{SessionId: sessionId, MessageId: env.Id, Status: StatusTimeout, Error: ctx.Err().Error()}}
+	}
+}
+
+func (cm *ConnectionManager) forwardRequest(ctx context.Context, owner *instance.Instance, req requestRequest, timeout time.Duration) requestResult {
+	sessionId := req.SessionId
+	// Give the owner the whole timeout to wait for the client, plus headroom for the hop itself.
+	ctx, cancel := context.WithTimeout(ctx, timeout+cm.cfg.Cluster.ForwardTimeout)
+	defer cancel()
+
+	var res requestResult
+	req.TimeoutMs = timeout.Milliseconds()
+	if _, err := cm.peers.Post(ctx, owner, "/internal/request", req, &res); err != nil {
+		logger.Errorf("Failed to forward request for sessionId: %s to %s. Error: %v", sessionId, owner.Addr(), err)
+		if errors.Is(err, cluster.ErrUnreachable) {
+			return requestResult{DeliveryResult: DeliveryResult{SessionId: sessionId, Status: StatusOwnerUnreachable, Error: err.Error()}}
+		}
+		return requestResult{DeliveryResult: DeliveryResult{SessionId: sessionId, Status: StatusFailed, Error: err.Error()}}
+	}
+	return res
+}
+
+func (cm *ConnectionManager) requestTimeout(timeoutMs int64) time.Duration {
+	timeout := cm.cfg.Request.Timeout
+	if timeoutMs > 0 {
+		timeout = time.Duration(timeoutMs) * time.Millisecond
+	}
+	if timeout > cm.cfg.Request.MaxTimeout {
+		timeout = cm.cfg.Request.MaxTimeout
+	}
+	return timeout
+}
+
+// Handles POST /request {sessionId, message, timeoutMs} and responds with the client's reply payload.
+func (cm *ConnectionManager) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req requestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.SessionId == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	res := cm.Request(r.Context(), req, cm.requestTimeout(req.TimeoutMs))
+	countOut("request", res.DeliveryResult)
+	if res.Status != StatusDelivered {
+		writeResult(w, res.DeliveryResult)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(res.Reply)
+}
+
+// Handles POST /internal/request from peer instances. The request is only sent to local clients.
+func (cm *ConnectionManager) HandleInternalRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req requestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	res := cm.requestLocal(r.Context(), req, cm.requestTimeout(req.TimeoutMs))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(res.Status.HTTPStatus())
+	_ = json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,153 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/jibitesh/request-response-manager/internal/logger"
+	"github.com/jibitesh/request-response-manager/internal/message"
+	"github.com/jibitesh/request-response-manager/internal/store"
+	"github.com/jibitesh/request-response-manager/pkg/instance"
+)
+
+const (
+	resumeTokenHeader = "X-Resume-Token"
+	sessionIdHeader   = "X-Session-Id"
+)
+
+type sessionPayload struct {
+	SessionId   string `json:"sessionId"`
+	ResumeToken string `json:"resumeToken"`
+	Resumed     bool   `json:"resumed"`
+	GraceMs     int64  `json:"graceMs"`
+}
+
+func resumeToken(r *http.Request) string {
+	if token := r.URL.Query().Get("resume"); token != "" {
+		return token
+	}
+	return r.Header.Get(resumeTokenHeader)
+}
+
+// sessionHeaders adds the session id and resume token to the response that
+// opens a connection, for clients that get no session frame.
+func sessionHeaders(h http.Header, si *store.SessionInfo) http.Header {
+	if h == nil {
+		h = http.Header{}
+	}
+	h.Set(sessionIdHeader, si.SessionId)
+	h.Set(resumeTokenHeader, si.ResumeToken)
+	return h
+}
+
+// openSession resumes the session named by the client's resume token, or
+// reclaims it when it was removed but is retained for its mail, or registers
+// si as a new session when there is no token or it is no longer valid.
+func (cm *ConnectionManager) openSession(ctx context.Context, token string, si *store.SessionInfo) (*store.SessionInfo, bool, error) {
+	if token != "" && cm.cfg.Session.ResumeGrace > 0 {
+		resumed, superseded, err := cm.sessionService.ResumeSession(ctx, token, si)
+		if err == nil {
+			cm.supersede(ctx, resumed.SessionId, superseded)
+			return resumed, true, nil
+		}
+		if !errors.Is(err, store.ErrInvalidResumeToken) {
+			return nil, false, err
+		}
+		reclaimed, err := cm.sessionService.ReclaimSession(ctx, token, si)
+		if err == nil {
+			logger.Infof("Reclaimed removed sessionId: %s", reclaimed.SessionId)
+			return reclaimed, false, nil
+		}
+		if !errors.Is(err, store.ErrInvalidResumeToken) {
+			return nil, false, err
+		}
+		logger.Infof("Rejected resume token, starting a new session: %s", si.SessionId)
+	}
+	si, err := cm.sessionService.AddSession(ctx, si)
+	return si, false, err
+}
+
+// supersede closes the connection a resumed session still had on another
+// instance. A connection on this instance is closed when the new one
+// replaces it in the connection map.
+func (cm *ConnectionManager) supersede(ctx context.Context, sessionId string, owner *instance.Instance) {
+	if owner == nil || owner.Equal(cm.sessionService.Instance()) {
+		return
+	}
+	req := adminRequest{SessionId: sessionId, Code: CloseSuperseded, Reason: "session resumed elsewhere"}
+	status, err := cm.peers.Post(ctx, owner, "/internal/admin/disconnect", req, nil)
+	if err == nil && status != http.StatusNoContent && status != http.StatusNotFound {
+		err = fmt.Errorf("peer answered %d", status)
+	}
+	if err != nil {
+		logger.Errorf("Failed to close superseded sessionId: %s on instance: %s. Error: %v", sessionId, owner.Name, err)
+	}
+}
+
+// greet tells the client its session id and next resume token. A resumed
+// session then gets what was buffered while it was detached and what it had
+// not acked; every session gets the mail kept for it and its user. Raw format
+// clients expect nothing but their messages, so they only get the session in
+// the headers of the response that opened the connection.
+func (cm *ConnectionManager) greet(ctx context.Context, si *store.SessionInfo, resumed bool) {
+	if cm.cfg.Message.Format != message.FormatRaw {
+		payload, _ := json.Marshal(sessionPayload{
+			SessionId:   si.SessionId,
+			ResumeToken: si.ResumeToken,
+			Resumed:     resumed,
+			GraceMs:     cm.cfg.Session.ResumeGrace.Milliseconds(),
+		})
+		if res := cm.deliverLocal(ctx, si.SessionId, message.New(message.TypeSession, payload)); res.Status != StatusDelivered {
+			logger.Errorf("Failed to send session info to sessionId: %s. Status: %s", si.SessionId, res.Status)
+			return
+		}
+	}
+	if resumed && !cm.replay(ctx, si.SessionId) {
+		return
+	}
+	cm.drainMail(ctx, si)
+}
+
+// replay writes the events the previous connection may have lost, the frames
+// buffered while the session was detached, and resends what it had not acked.
+// It reports whether the client took them all.
+func (cm *ConnectionManager) replay(ctx context.Context, sessionId string) bool {
+	if !cm.replayEvents(ctx, sessionId) {
+		return false
+	}
+	frames, err := cm.sessionService.DrainBuffer(ctx, sessionId)
+	if err != nil {
+		logger.Errorf("Failed to drain replay buffer of sessionId: %s. Error: %v", sessionId, err)
+		return false
+	}
+	for _, frame := range frames {
+		var env message.Envelope
+		if err := json.Unmarshal(frame, &env); err != nil {
+			continue
+		}
+		if res := cm.deliverLocal(ctx, sessionId, &env); res.Status != StatusDelivered {
+			logger.Errorf("Failed to replay message: %s to sessionId: %s. Status: %s", env.Id, sessionId, res.Status)
+			return false
+		}
+	}
+	if len(frames) > 0 {
+		logger.Infof("Replayed %d buffered messages to sessionId: %s", len(frames), sessionId)
+	}
+	return cm.resendUnacked(ctx, sessionId)
+}
+
+// buffer keeps env for a detached session so it is replayed on resume.
+func (cm *ConnectionManager) buffer(ctx context.Context, sessionId string, env *message.Envelope) DeliveryResult {
+	frame, err := json.Marshal(env)
+	if err == nil {
+		err = cm.sessionService.BufferMessage(ctx, sessionId, frame, cm.cfg.Session.ReplayBufferSize, cm.cfg.Session.ResumeGrace)
+	}
+	if err != nil {
+		logger.Errorf("Failed to buffer message for sessionId: %s. Error: %v", sessionId, err)
+		return DeliveryResult{SessionId: sessionId, MessageId: env.Id, Status: StatusFailed, Error: err.Error()}
+	}
+	return DeliveryResult{SessionId: sessionId, MessageId: env.Id, Status: StatusBuffered}
+}
@@ -0,0 +1,312 @@
+package ws
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/jibitesh/request-response-manager/internal/config"
+	"github.com/jibitesh/request-response-manager/internal/logger"
+	"github.com/jibitesh/request-response-manager/internal/store"
+)
+
+const (
+	TransportWebSocket = "websocket"
+	TransportSSE       = "sse"
+	TransportPoll      = "poll"
+)
+
+const (
+	OverflowBlock      = "block"
+	OverflowDropOldest = "drop_oldest"
+	OverflowDisconnect = "disconnect"
+)
+
+var (
+	ErrSessionClosed = errors.New("ws: session closed")
+	ErrQueueFull     = errors.New("ws: outbound queue full")
+	ErrDropped       = errors.New("ws: message dropped from full outbound queue")
+)
+
+type outbound struct {
+	messageType int
+	data        []byte
+	prepared    *websocket.PreparedMessage
+	// closing makes the writer send a close frame instead of data.
+	closing *closeFrame
+	done    chan error
+}
+
+type closeFrame struct {
+	code   int
+	reason string
+}
+
+// transport carries a session's frames to its client over one kind of connection.
+type transport interface {
+	name() string
+	write(out *outbound, deadline time.Time) error
+	writeClose(code int, reason string, deadline time.Time) error
+	close() error
+}
+
+type wsTransport struct {
+	conn *websocket.Conn
+}
+
+func (t *wsTransport) name() string {
+	return TransportWebSocket
+}
+
+func (t *wsTransport) write(out *outbound, deadline time.Time) error {
+	_ = t.conn.SetWriteDeadline(deadline)
+	if out.prepared != nil {
+		return t.conn.WritePreparedMessage(out.prepared)
+	}
+	return t.conn.WriteMessage(out.messageType, out.data)
+}
+
+func (t *wsTransport) writeClose(code int, reason string, deadline time.Time) error {
+	return t.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline)
+}
+
+func (t *wsTransport) close() error {
+	return t.conn.Close()
+}
+
+// Session owns a client connection's write side. All data frames go through a
+// bounded queue drained by a single writer goroutine, since gorilla/websocket
+// allows only one concurrent writer. Control frames may bypass the queue.
+type Session struct {
+	id        string
+	transport transport
+	// conn is the client's websocket, nil for other transports.
+	conn         *websocket.Conn
+	subprotocol  string
+	userId       string
+	claims       map[string]interface{}
+	remoteAddr   string
+	userAgent    string
+	connectedAt  time.Time
+	queue        chan *outbound
+	overflow     string
+	writeTimeout time.Duration
+	blockTimeout time.Duration
+	closed       chan struct{}
+	// stopped is closed once the writer goroutine has returned.
+	stopped   chan struct{}
+	closeOnce sync.Once
+	// upstream holds the client's messages for a single dispatcher, so they
+	// reach upstream in the order they were received.
+	upstream     chan *inbound
+	upstreamOnce sync.Once
+	dropMu       sync.Mutex
+	lastActivity atomic.Int64
+	messagesIn   atomic.Int64
+	messagesOut  atomic.Int64
+	bytesIn      atomic.Int64
+	bytesOut     atomic.Int64
+}
+
+func newSession(cfg *config.Config, id string, t transport) *Session {
+	s := &Session{
+		id:           id,
+		transport:    t,
+		queue:        make(chan *outbound, cfg.Connection.QueueSize),
+		upstream:     make(chan *inbound, cfg.Upstream.QueueSize),
+		overflow:     cfg.Connection.Overflow,
+		writeTimeout: cfg.Connection.WriteTimeout,
+		blockTimeout: cfg.Connection.BlockTimeout,
+		closed:       make(chan struct{}),
+		stopped:      make(chan struct{}),
+		connectedAt:  time.Now(),
+	}
+	s.touch()
+	go s.writeLoop()
+	return s
+}
+
+func newWSSession(cfg *config.Config, id string, conn *websocket.Conn) *Session {
+	s := newSession(cfg, id, &wsTransport{conn: conn})
+	s.conn = conn
+	return s
+}
+
+// identify records the identity of the session's client.
+func (s *Session) identify(si *store.SessionInfo) {
+	s.subprotocol = si.Subprotocol
+	s.userId = si.UserId
+	s.claims = si.Claims
+}
+
+// from records where the session's client connected from.
+func (s *Session) from(id *identity) {
+	s.remoteAddr = id.remoteAddr
+	s.userAgent = id.userAgent
+}
+
+// Send queues a frame and waits until the writer has written it or failed.
+func (s *Session) Send(messageType int, data []byte) error {
+	return s.send(&outbound{messageType: messageType, data: data, done: make(chan error, 1)})
+}
+
+// SendPrepared queues a frame encoded once for many connections and waits
+// until the writer has written it or failed. Transports that cannot use pm
+// write data as text instead.
+func (s *Session) SendPrepared(pm *websocket.PreparedMessage, data []byte) error {
+	return s.send(&outbound{messageType: websocket.TextMessage, data: data, prepared: pm, done: make(chan error, 1)})
+}
+
+func (s *Session) send(out *outbound) error {
+	if err := s.enqueue(out); err != nil {
+		return err
+	}
+	select {
+	case err := <-out.done:
+		return err
+	case <-s.closed:
+		return ErrSessionClosed
+	}
+}
+
+func (s *Session) enqueue(out *outbound) error {
+	select {
+	case <-s.closed:
+		return ErrSessionClosed
+	default:
+	}
+
+	switch s.overflow {
+	case OverflowDropOldest:
+		s.dropMu.Lock()
+		defer s.dropMu.Unlock()
+		for {
+			select {
+			case s.queue <- out:
+				return nil
+			default:
+			}
+			select {
+			case oldest := <-s.queue:
+				oldest.done <- ErrDropped
+			default:
+			}
+		}
+	case OverflowDisconnect:
+		select {
+		case s.queue <- out:
+			return nil
+		default:
+			logger.Errorf("Outbound queue full for sessionId: %s. Disconnecting.", s.id)
+			s.Close()
+			return ErrQueueFull
+		}
+	default:
+		timer := time.NewTimer(s.blockTimeout)
+		defer timer.Stop()
+		select {
+		case s.queue <- out:
+			return nil
+		case <-timer.C:
+			return ErrQueueFull
+		case <-s.closed:
+			return ErrSessionClosed
+		}
+	}
+}
+
+func (s *Session) writeLoop() {
+	defer close(s.stopped)
+	for {
+		select {
+		case out := <-s.queue:
+			var err error
+			if out.closing != nil {
+				err = s.transport.writeClose(out.closing.code, out.closing.reason, time.Now().Add(s.writeTimeout))
+			} else {
+				err = s.transport.write(out, time.Now().Add(s.writeTimeout))
+			}
+			out.done <- err
+			if err == nil && out.closing == nil && out.messageType != websocket.PingMessage {
+				s.messagesOut.Add(1)
+				s.bytesOut.Add(int64(len(out.data)))
+			}
+			if err != nil {
+				logger.Errorf("Failed to write to %s of sessionId: %s. Error: %v", s.transport.name(), s.id, err)
+				s.Close()
+			}
+		case <-s.closed:
+			for {
+				select {
+				case out := <-s.queue:
+					out.done <- ErrSessionClosed
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *Session) touch() {
+	s.lastActivity.Store(time.Now().UnixNano())
+}
+
+// received counts a data frame of n bytes from the client.
+func (s *Session) received(n int) {
+	s.touch()
+	s.messagesIn.Add(1)
+	s.bytesIn.Add(int64(n))
+}
+
+// Transport names the kind of connection the client uses.
+func (s *Session) Transport() string {
+	return s.transport.name()
+}
+
+// Subprotocol is the application subprotocol negotiated for the connection.
+func (s *Session) Subprotocol() string {
+	return s.subprotocol
+}
+
+// LastActivity is the time the client last sent a data frame.
+func (s *Session) LastActivity() time.Time {
+	return time.Unix(0, s.lastActivity.Load())
+}
+
+// CloseWithReason sends a close frame before closing the connection.
+func (s *Session) CloseWithReason(code int, reason string) {
+	_ = s.transport.writeClose(code, reason, time.Now().Add(s.writeTimeout))
+	s.Close()
+}
+
+// CloseAfterFlush writes every frame already queued, then a close frame. A
+// websocket stays open for the client to answer the close; other transports
+// are closed once the frame is written.
+func (s *Session) CloseAfterFlush(code int, reason string) error {
+	out := &outbound{closing: &closeFrame{code: code, reason: reason}, done: make(chan error, 1)}
+	select {
+	case s.queue <- out:
+	case <-s.closed:
+		return ErrSessionClosed
+	}
+	var err error
+	select {
+	case err = <-out.done:
+	case <-s.closed:
+		return ErrSessionClosed
+	}
+	if s.conn == nil {
+		s.Close()
+	}
+	return err
+}
+
+func (s *Session) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		_ = s.transport.close()
+	})
+}
@@ -20,7 +20,9 @@ func SessionLookupHandler(service *store.SessionService) http.HandlerFunc {
 			return
 		} else if err != nil {
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
 		}
+		si.ResumeToken = ""
 		w.Header().Set("Content-Type", "application/json")
 		_ = json.NewEncoder(w).Encode(si)
 	}
@@ -0,0 +1,293 @@
+package ws
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/jibitesh/request-response-manager/internal/logger"
+	"github.com/jibitesh/request-response-manager/internal/message"
+	"github.com/jibitesh/request-response-manager/internal/metrics"
+	"github.com/jibitesh/request-response-manager/internal/store"
+)
+
+// keptEvent is an SSE event remembered so it can be replayed to a client that
+// reconnects with an earlier Last-Event-ID.
+type keptEvent struct {
+	Seq  uint64 `json:"seq"`
+	Data string `json:"data"`
+}
+
+// sseTransport streams frames as Server-Sent Events. Event ids are
+// "<stream id>:<seq>", so the Last-Event-ID a reconnecting EventSource sends
+// both resumes the session and tells which events it already has. The stream
+// id is random per connection and maps to the resume token only server-side,
+// for a single resume, so the token never shows up in event ids.
+type sseTransport struct {
+	mu     sync.Mutex
+	w      http.ResponseWriter
+	rc     *http.ResponseController
+	stream string
+	seq    uint64
+	recent []keptEvent
+	max    int
+	// resumedFrom is the last event seq the client had when it reconnected.
+	resumedFrom uint64
+	// finished is set once HandleSSE is about to return and w is unusable.
+	finished bool
+}
+
+func (t *sseTransport) name() string {
+	return TransportSSE
+}
+
+func (t *sseTransport) write(out *outbound, deadline time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.finished {
+		return ErrSessionClosed
+	}
+	_ = t.rc.SetWriteDeadline(deadline)
+	if out.messageType == websocket.PingMessage {
+		if _, err := fmt.Fprint(t.w, ": ping\n\n"); err != nil {
+			return err
+		}
+		return t.rc.Flush()
+	}
+
+	t.seq++
+	if err := t.writeEvent("message", fmt.Sprintf("%s:%d", t.stream, t.seq), out.data); err != nil {
+		return err
+	}
+	if t.max > 0 {
+		t.recent = append(t.recent, keptEvent{Seq: t.seq, Data: string(out.data)})
+		if len(t.recent) > t.max {
+			t.recent = t.recent[len(t.recent)-t.max:]
+		}
+	}
+	return nil
+}
+
+func (t *sseTransport) writeClose(code int, reason string, deadline time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.finished {
+		return ErrSessionClosed
+	}
+	_ = t.rc.SetWriteDeadline(deadline)
+	data, _ := json.Marshal(map[string]interface{}{"code": code, "reason": reason})
+	return t.writeEvent("close", "", data)
+}
+
+// close is a no-op; the stream ends when HandleSSE returns.
+func (t *sseTransport) close() error {
+	return nil
+}
+
+func (t *sseTransport) finish() {
+	t.mu.Lock()
+	t.finished = true
+	t.mu.Unlock()
+}
+
+func (t *sseTransport) writeEvent(event, id string, data []byte) error {
+	var b strings.Builder
+	b.WriteString("event: " + event + "\n")
+	if id != "" {
+		b.WriteString("id: " + id + "\n")
+	}
+	// A bare CR also ends a line in the event stream format.
+	text := strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(string(data))
+	for _, line := range strings.Split(text, "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+	if _, err := t.w.Write([]byte(b.String())); err != nil {
+		return err
+	}
+	return t.rc.Flush()
+}
+
+// kept returns the recent events encoded for KeepEvents.
+func (t *sseTransport) kept() [][]byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	events := make([][]byte, 0, len(t.recent))
+	for _, ev := range t.recent {
+		b, _ := json.Marshal(ev)
+		events = append(events, b)
+	}
+	return events
+}
+
+// newStreamId returns a random id for an event stream.
+func newStreamId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// parseEventId splits a Last-Event-ID into the stream id and event seq.
+func parseEventId(id string) (string, uint64) {
+	i := strings.LastIndex(id, ":")
+	if i < 0 {
+		return "", 0
+	}
+	seq, err := strconv.ParseUint(id[i+1:], 10, 64)
+	if err != nil {
+		return "", 0
+	}
+	return id[:i], seq
+}
+
+// HandleSSE serves GET /sse, streaming server-to-client messages as events
+// for clients that cannot open a websocket. Sessions are registered like
+// websocket ones, so senders do not need to know which transport is used.
+func (cm *ConnectionManager) HandleSSE(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, ok := cm.admit(w, r, TransportSSE)
+	if !ok {
+		return
+	}
+
+	lastEventId := r.Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = r.URL.Query().Get("lastEventId")
+	}
+	ctx := context.Background()
+	stream, lastSeq := parseEventId(lastEventId)
+	var token string
+	var err error
+	if stream != "" {
+		if token, err = cm.sessionService.ClaimStream(ctx, stream); err != nil {
+			logger.Errorf("Failed to look up event stream: %s. Error: %v", stream, err)
+		}
+	}
+	if token == "" {
+		token = resumeToken(r)
+	}
+	if stream, err = newStreamId(); err != nil {
+		metrics.UpgradeFailures.Inc(TransportSSE, "session")
+		logger.Errorf("new stream id: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	si, resumed, err := cm.openSession(ctx, token, &store.SessionInfo{
+		SessionId: uuid.NewString(),
+		UserId:    id.userId,
+		Claims:    id.claims,
+	})
+	if err != nil {
+		metrics.UpgradeFailures.Inc(TransportSSE, "session")
+		logger.Errorf("set session: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	sessionId := si.SessionId
+
+	allowOrigin(w, r)
+	sessionHeaders(w.Header(), si)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	t := &sseTransport{w: w, rc: http.NewResponseController(w), stream: stream, max: cm.cfg.Session.ReplayBufferSize}
+	if resumed {
+		t.seq, t.resumedFrom = lastSeq, lastSeq
+	}
+	sess := newSession(cm.cfg, sessionId, t)
+	sess.identify(si)
+	sess.from(id)
+	if timer := id.expireAt(sess); timer != nil {
+		defer timer.Stop()
+	}
+	cm.addConnection(sessionId, sess)
+	cm.greet(ctx, si, resumed)
+
+	ticker := time.NewTicker(cm.cfg.Connection.PingInterval)
+	defer ticker.Stop()
+stream:
+	for {
+		select {
+		case <-r.Context().Done():
+			logger.Infof("Event stream closed by client for sessionId: %s", sessionId)
+			break stream
+		case <-sess.closed:
+			break stream
+		case <-ticker.C:
+			if err := sess.Send(websocket.PingMessage, nil); err != nil {
+				break stream
+			}
+		}
+	}
+	// The response writer must not be used once this handler returns.
+	sess.Close()
+	<-sess.stopped
+	t.finish()
+
+	if cm.removeConnection(sessionId, sess) {
+		if err := cm.sessionService.KeepEvents(ctx, sessionId, t.kept(), cm.cfg.Session.ResumeGrace); err != nil {
+			logger.Errorf("Failed to keep recent events of sessionId: %s. Error: %v", sessionId, err)
+		}
+		if err := cm.sessionService.ReleaseSession(ctx, sessionId, cm.cfg.Session.ResumeGrace); err != nil {
+			logger.Errorf("Failed to release session: %s with error: %v", sessionId, err)
+		} else if err := cm.sessionService.KeepStream(ctx, stream, si.ResumeToken, cm.cfg.Session.ResumeGrace); err != nil {
+			logger.Errorf("Failed to keep event stream of sessionId: %s. Error: %v", sessionId, err)
+		}
+	}
+}
+
+// replayEvents resends the events a streaming session's previous connection
+// wrote that the client did not confirm having through Last-Event-ID.
+func (cm *ConnectionManager) replayEvents(ctx context.Context, sessionId string) bool {
+	events, err := cm.sessionService.DrainEvents(ctx, sessionId)
+	if err != nil {
+		logger.Errorf("Failed to drain recent events of sessionId: %s. Error: %v", sessionId, err)
+		return false
+	}
+	sess := cm.session(sessionId)
+	if sess == nil || len(events) == 0 {
+		return sess != nil
+	}
+	var after uint64
+	if t, ok := sess.transport.(*sseTransport); ok {
+		after = t.resumedFrom
+	}
+
+	var replayed int
+	for _, raw := range events {
+		var ev keptEvent
+		if err := json.Unmarshal(raw, &ev); err != nil || ev.Seq <= after {
+			continue
+		}
+		// The old session frame carries a rotated resume token.
+		if env, err := message.Parse([]byte(ev.Data)); err == nil && env.Type == message.TypeSession {
+			continue
+		}
+		if err := sess.Send(websocket.TextMessage, []byte(ev.Data)); err != nil {
+			logger.Errorf("Failed to replay event: %d to sessionId: %s. Error: %v", ev.Seq, sessionId, err)
+			return false
+		}
+		replayed++
+	}
+	if replayed > 0 {
+		logger.Infof("Replayed %d missed events to sessionId: %s", replayed, sessionId)
+	}
+	return true
+}
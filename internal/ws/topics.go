@@ -0,0 +1,162 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/jibitesh/request-response-manager/internal/logger"
+	"github.com/jibitesh/request-response-manager/internal/message"
+	"github.com/jibitesh/request-response-manager/internal/store"
+)
+
+type topicsPayload struct {
+	Topics []string `json:"topics"`
+}
+
+type subscriptionRequest struct {
+	SessionId string   `json:"sessionId"`
+	Topics    []string `json:"topics"`
+}
+
+type subscriptionResult struct {
+	SessionId string   `json:"sessionId"`
+	Topics    []string `json:"topics"`
+}
+
+type publishResult struct {
+	Topic      string                 `json:"topic"`
+	MessageId  string                 `json:"messageId"`
+	Recipients int                    `json:"recipients"`
+	Results    map[DeliveryStatus]int `json:"results"`
+}
+
+func validTopics(topics []string) bool {
+	if len(topics) == 0 {
+		return false
+	}
+	for _, topic := range topics {
+		if topic == "" {
+			return false
+		}
+	}
+	return true
+}
+
+func (cm *ConnectionManager) updateSubscription(ctx context.Context, typ, sessionId string, topics []string) ([]string, error) {
+	var err error
+	if typ == message.TypeSubscribe {
+		err = cm.sessionService.Subscribe(ctx, sessionId, topics)
+	} else {
+		err = cm.sessionService.Unsubscribe(ctx, sessionId, topics)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cm.sessionService.Topics(ctx, sessionId)
+}
+
+// handleSubscription serves subscribe and unsubscribe control messages from a
+// client and answers with the session's current topics.
+func (cm *ConnectionManager) handleSubscription(sessionId string, env *message.Envelope) {
+	var p topicsPayload
+	if err := json.Unmarshal(env.Payload, &p); err != nil || !validTopics(p.Topics) {
+		logger.Infof("Invalid %s message from sessionId: %s", env.Type, sessionId)
+		return
+	}
+	ctx := context.Background()
+	topics, err := cm.updateSubscription(ctx, env.Type, sessionId, p.Topics)
+	if err != nil {
+		logger.Errorf("Failed to %s sessionId: %s. Error: %v", env.Type, sessionId, err)
+		return
+	}
+
+	b, _ := json.Marshal(topicsPayload{Topics: topics})
+	reply := message.New(message.TypeResponse, b)
+	reply.CorrelationId = env.Id
+	cm.deliverLocal(ctx, sessionId, reply)
+}
+
+// Handles POST /subscribe and POST /unsubscribe {sessionId, topics}
+func (cm *ConnectionManager) HandleSubscription(typ string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req subscriptionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !validTopics(req.Topics) {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if _, err := cm.sessionService.GetSession(r.Context(), req.SessionId); errors.Is(err, store.ErrNotFound) {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		topics, err := cm.updateSubscription(r.Context(), typ, req.SessionId, req.Topics)
+		if err != nil {
+			logger.Errorf("Failed to %s sessionId: %s. Error: %v", typ, req.SessionId, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(subscriptionResult{SessionId: req.SessionId, Topics: topics})
+	}
+}
+
+// Publish delivers env to every subscriber of topic across the cluster.
+func (cm *ConnectionManager) Publish(ctx context.Context, topic string, env *message.Envelope) (*publishResult, error) {
+	ids, err := cm.sessionService.Subscribers(ctx, topic)
+	if err != nil {
+		return nil, err
+	}
+	results, stale, err := cm.fanOut(ctx, ids, env)
+	if err != nil {
+		return nil, err
+	}
+	if len(stale) > 0 {
+		cm.sessionService.PruneSubscribers(ctx, topic, stale)
+	}
+	return &publishResult{
+		Topic:      topic,
+		MessageId:  env.Id,
+		Recipients: len(results),
+		Results:    countByStatus(results),
+	}, nil
+}
+
+// Handles POST /publish {topic, message} or {topic, envelope}
+func (cm *ConnectionManager) HandlePublish(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Topic string `json:"topic"`
+		payload
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Topic == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	env, err := req.envelope()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res, err := cm.Publish(r.Context(), req.Topic, env)
+	if err != nil {
+		logger.Errorf("Failed to publish to topic: %s. Error: %v", req.Topic, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	countOutByStatus("publish", res.Results)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
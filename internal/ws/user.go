@@ -0,0 +1,83 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/jibitesh/request-response-manager/internal/logger"
+	"github.com/jibitesh/request-response-manager/internal/message"
+	"github.com/jibitesh/request-response-manager/internal/store"
+)
+
+type userSendResult struct {
+	UserId    string           `json:"userId"`
+	MessageId string           `json:"messageId"`
+	Results   []DeliveryResult `json:"results"`
+	Mailboxed bool             `json:"mailboxed,omitempty"`
+}
+
+// SendToUser delivers env to every live session of userId across the cluster.
+func (cm *ConnectionManager) SendToUser(ctx context.Context, userId string, env *message.Envelope) (*userSendResult, error) {
+	ids, err := cm.sessionService.UserSessions(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	results, stale, err := cm.fanOut(ctx, ids, env)
+	if err != nil {
+		return nil, err
+	}
+	if len(stale) > 0 {
+		cm.sessionService.PruneUserSessions(ctx, userId, stale)
+	}
+	return &userSendResult{UserId: userId, MessageId: env.Id, Results: results}, nil
+}
+
+// Handles POST /send/user {userId, message} or {userId, envelope}. With
+// mailbox the message is kept for the user when none of their sessions got it.
+func (cm *ConnectionManager) HandleSendUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		UserId       string `json:"userId"`
+		Mailbox      bool   `json:"mailbox"`
+		MailboxTtlMs int64  `json:"mailboxTtlMs"`
+		payload
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserId == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	env, err := req.envelope()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res, err := cm.SendToUser(r.Context(), req.UserId, env)
+	if err != nil {
+		logger.Errorf("Failed to send to userId: %s. Error: %v", req.UserId, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if req.Mailbox && !anyReached(res.Results) {
+		if mailed := cm.mail(r.Context(), store.MailboxUser, req.UserId, env, req.MailboxTtlMs); mailed.Status == StatusMailboxed {
+			res.Mailboxed = true
+		}
+	}
+	countOut("send_user", res.Results...)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// anyReached reports whether some session got the message or will on resume.
+func anyReached(results []DeliveryResult) bool {
+	for _, res := range results {
+		if res.Status == StatusDelivered || res.Status == StatusBuffered {
+			return true
+		}
+	}
+	return false
+}
@@ -2,12 +2,18 @@ package instance
 
 import (
 	"errors"
+	"fmt"
 	"net"
+	"os"
+	"strconv"
 
 	"github.com/jibitesh/request-response-manager/internal/config"
 	"github.com/jibitesh/request-response-manager/internal/logger"
 )
 
+// Version is the build version, set with -ldflags "-X .../pkg/instance.Version=...".
+var Version = "dev"
+
 type Instance struct {
 	Name string `json:"name"`
 	Ip   string `json:"ip"`
@@ -33,6 +39,22 @@ func getIp() (string, error) {
 	return "", errors.New("could not find a valid private IP address")
 }
 
+// getName resolves the instance id from config, then the pod name, then the
+// hostname suffixed with the port so instances sharing a host stay distinct.
+func getName(port int) (string, error) {
+	if id := config.AppConfig.Instance.Id; id != "" {
+		return id, nil
+	}
+	if pod := os.Getenv("POD_NAME"); pod != "" {
+		return pod, nil
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%d", hostname, port), nil
+}
+
 func GetInstance() (*Instance, error) {
 	ip, err := getIp()
 	if err != nil {
@@ -40,10 +62,25 @@ func GetInstance() (*Instance, error) {
 		return nil, err
 	}
 	port := config.AppConfig.Server.Port
-	logger.Infof("Local Private Ip Address: %s Port: %d", ip, port)
+	name, err := getName(port)
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("Instance: %s Local Private Ip Address: %s Port: %d", name, ip, port)
 	return &Instance{
-		Name: "none",
+		Name: name,
 		Ip:   ip,
 		Port: port,
 	}, nil
 }
+
+func (i *Instance) Addr() string {
+	return net.JoinHostPort(i.Ip, strconv.Itoa(i.Port))
+}
+
+func (i *Instance) Equal(other *Instance) bool {
+	if i == nil || other == nil {
+		return i == other
+	}
+	return i.Name == other.Name && i.Ip == other.Ip && i.Port == other.Port
+}